@@ -38,10 +38,13 @@ func main() {
 	runtime.GC()
 	time.Sleep(250 * time.Millisecond)
 
-	db.Dump(attribute.DumpOpts{
+	err = db.Dump(attribute.DumpOpts{
 		OnlyCategoryID:  *dumpCategoryRule,
 		MaxLinesToPrint: 100,
 	})
+	if err != nil {
+		panic(err)
+	}
 
 	PrintMemUsage()
 
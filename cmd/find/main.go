@@ -14,9 +14,15 @@ import (
 func main() {
 	dataDir := pflag.StringP("data", "d", "", "Dir with gzipped CSV files containing exported tables from the Item Attributes Postgres database (e.g. attributes.csv.gz)")
 	categoriesFile := pflag.StringP("cats", "c", "", "Item categories file (.json.gz format)")
-	selectedCategoryID := pflag.Int("cid", 242, "Selected category ID")
+	selectedCategoryIDs := pflag.IntSlice("cid", []int{242}, "Selected category IDs")
+	intersect := pflag.Bool("intersect", false, "Only show attributes common to all selected categories")
 	selectedAttributes := pflag.StringSliceP("attrs", "a", []string{}, "Selected attributes")
 	pageSize := pflag.Int("page", 3, "Page size / max number of options to return per attribute")
+	offset := pflag.Int("offset", 0, "Skip the first X options shown (after filtering) of each attribute")
+	filters := pflag.StringSliceP("filters", "f", []string{}, "Filter options of attributes, e.g. 1893=しゃねる (matches titles or subtitles containing the text, ignoring case, width and kana type)")
+	sortOptions := pflag.String("sort", "", "Sort options by display_order (default), alphabetical or popularity")
+	cursors := pflag.StringSlice("cursors", []string{}, "Fetch the next page of options for attributes (cursors are printed in the result)")
+	explain := pflag.Bool("explain", false, "Explain why attributes and options are visible and why selected attributes were removed")
 
 	pflag.Parse()
 
@@ -39,14 +45,26 @@ func main() {
 
 	db.PreSort()
 
-	db.Dump(attribute.DumpOpts{
-		OnlyCategoryID:  *selectedCategoryID,
-		MaxLinesToPrint: 100,
-	})
+	for _, id := range *selectedCategoryIDs {
+		err = db.Dump(attribute.DumpOpts{
+			OnlyCategoryID:  id,
+			MaxLinesToPrint: 100,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	sc := &attribute.SearchConditions{
-		CategoryIDs: []int{*selectedCategoryID},
+		CategoryIDs: *selectedCategoryIDs,
 		PageSize:    *pageSize,
+		Offset:      *offset,
+		Cursors:     *cursors,
+		Sort:        attribute.OptionSort(*sortOptions),
+		Explain:     *explain,
+	}
+	if *intersect {
+		sc.CategoryMatch = attribute.CategoryMatchIntersection
 	}
 	if len(*selectedAttributes) > 0 {
 		for _, s := range *selectedAttributes {
@@ -62,6 +80,23 @@ func main() {
 		}
 	}
 
+	for _, s := range *filters {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		attributeID, _ := strconv.Atoi(parts[0])
+
+		sc.Filters = append(sc.Filters, &attribute.OptionFilter{
+			AttributeID: attributeID,
+			Query:       parts[1],
+			Match:       attribute.MatchContains,
+			Fold:        true,
+			Subtitle:    true,
+		})
+	}
+
 	res, err := attribute.FindVisibleAttributes(sc, db)
 	if err != nil {
 		panic(err)
@@ -71,8 +106,24 @@ func main() {
 
 	for _, va := range res.VAs {
 		fmt.Printf(" - attribute [%-6d] - %s\n", va.ID, va.Title)
+		if va.Explanation != nil {
+			fmt.Printf("      (%s)\n", va.Explanation.Message)
+		}
 		for _, vo := range va.Os {
 			fmt.Printf("    - option [%-6d] - %s\n", vo.ID, vo.Title)
+			if vo.Explanation != nil && vo.Explanation.Reason != attribute.ReasonAlwaysVisible {
+				fmt.Printf("        (%s)\n", vo.Explanation.Message)
+			}
+		}
+		if va.NextCursor != "" {
+			fmt.Printf("    - next cursor: %s\n", va.NextCursor)
+		}
+	}
+
+	for _, rc := range res.Removed {
+		fmt.Printf(" - removed attribute [%-6d] option [%-6d] - %s\n", rc.AttributeID, rc.OptionID, rc.Reason)
+		if rc.Explanation != nil {
+			fmt.Printf("      (%s)\n", rc.Explanation.Message)
 		}
 	}
 
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/anrid/attribute-filters/pkg/attribute"
+	"github.com/anrid/attribute-filters/pkg/importer"
 	"github.com/spf13/pflag"
 )
 
@@ -15,6 +16,11 @@ func main() {
 	categoriesFile := pflag.StringP("cats", "c", "", "Item categories file in JSON format")
 	expandDB := pflag.Int("expand-db", 0, "Import the same Postgres data <X> times, effectively making the attributes DB <X> times larger")
 	dumpCategoryRule := pflag.Int("dump", 242, "Dump rule for category ID X")
+	popularityFile := pflag.String("popularity", "", "CSV file with item to attribute/option relationships (see ConvertItemAttributeRelationships) used to sort options by popularity")
+	onError := pflag.String("on-error", string(importer.FailFast), "What to do with bad records: fail_fast, skip or dead_letter")
+	maxErrors := pflag.Int("max-errors", 0, "Stop when more than X records are bad (0 = no limit)")
+	deadLetterFile := pflag.String("dead-letter", "", "Write bad records to this CSV file and carry on (implies --on-error dead_letter)")
+	snapshotFile := pflag.StringP("snapshot", "s", "", "Write a binary snapshot of the attributes DB to this file (can be loaded by other commands using --snapshot)")
 
 	pflag.Parse()
 
@@ -30,13 +36,23 @@ func main() {
 		panic(err)
 	}
 
+	errs := importer.ErrorHandling{Policy: importer.ErrorPolicy(*onError), MaxErrors: *maxErrors}
+	if *deadLetterFile != "" {
+		errs.Policy = importer.DeadLetter
+		errs.DeadLetter, err = importer.NewDeadLetterFile(*deadLetterFile)
+		if err != nil {
+			panic(err)
+		}
+		defer errs.DeadLetter.Close()
+	}
+
 	if *expandDB > 0 {
 		// Import the same Postgres database X times effectively making the DB X times larger
 		// Used for load testing purposes
 		for i := 0; i < *expandDB; i++ {
 			db.ForceAppendSuffixToAllConvertedKeys(fmt.Sprintf("-expanded-%03d", i))
 
-			err := db.ImportPostgresDatabase(attribute.ImportPostgresDatabaseArgs{Dir: *dataDir})
+			err := db.ImportPostgresDatabase(attribute.ImportPostgresDatabaseArgs{Dir: *dataDir, Errors: errs})
 			if err != nil {
 				panic(err)
 			}
@@ -47,7 +63,7 @@ func main() {
 		}
 	} else {
 		// Import data normally
-		err := db.ImportPostgresDatabase(attribute.ImportPostgresDatabaseArgs{Dir: *dataDir})
+		err := db.ImportPostgresDatabase(attribute.ImportPostgresDatabaseArgs{Dir: *dataDir, Errors: errs})
 		if err != nil {
 			panic(err)
 		}
@@ -55,11 +71,40 @@ func main() {
 
 	db.PreSort()
 
+	if *popularityFile != "" {
+		err = db.LoadOptionPopularityCSV(*popularityFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *snapshotFile != "" {
+		f, err := os.Create(*snapshotFile)
+		if err != nil {
+			panic(err)
+		}
+
+		err = db.SaveSnapshot(f)
+		if err != nil {
+			panic(err)
+		}
+
+		err = f.Close()
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Wrote snapshot to %s\n", *snapshotFile)
+	}
+
 	if *dumpCategoryRule > 0 {
-		db.Dump(attribute.DumpOpts{
+		err = db.Dump(attribute.DumpOpts{
 			OnlyCategoryID:  *dumpCategoryRule,
 			MaxLinesToPrint: 100,
 		})
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	PrintMemUsage()
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/anrid/attribute-filters/pkg/attribute"
 	"github.com/anrid/attribute-filters/pkg/elastic"
+	"github.com/anrid/attribute-filters/pkg/importer"
+	"github.com/anrid/attribute-filters/pkg/store"
 	"github.com/spf13/pflag"
 )
 
@@ -15,6 +18,14 @@ func main() {
 	prefixFilter := pflag.StringP("filename-prefix-filter", "f", "items", "filename prefix to match on the given Items dir")
 	batchSize := pflag.Int("batch-size", 5000, "batch size, i.e. number of items to insert into ES at a time")
 	max := pflag.Int("max", 20_000, "process max X items before exiting")
+	workers := pflag.Int("workers", 1, "number of item files to read and decode in parallel")
+	consumers := pflag.Int("consumers", 1, "number of bulk index requests to send to ES in parallel")
+	unordered := pflag.Bool("unordered", false, "index items as soon as they're read instead of file by file")
+	onError := pflag.String("on-error", string(importer.FailFast), "What to do with bad records: fail_fast, skip or dead_letter")
+	maxErrors := pflag.Int("max-errors", 0, "Stop when more than X records are bad (0 = no limit)")
+	deadLetterFile := pflag.String("dead-letter", "", "Write bad records to this CSV file and carry on (implies --on-error dead_letter)")
+	checkpointDir := pflag.String("checkpoint-dir", "", "Badger DB dir to save a checkpoint in after each batch indexed")
+	resume := pflag.Bool("resume", false, "Continue from the last batch indexed instead of starting over (requires --checkpoint-dir)")
 
 	pflag.Parse()
 
@@ -40,13 +51,43 @@ func main() {
 		panic(err)
 	}
 
-	elastic.Index(elastic.IndexArgs{
+	errs := importer.ErrorHandling{Policy: importer.ErrorPolicy(*onError), MaxErrors: *maxErrors}
+	if *deadLetterFile != "" {
+		errs.Policy = importer.DeadLetter
+		errs.DeadLetter, err = importer.NewDeadLetterFile(*deadLetterFile)
+		if err != nil {
+			panic(err)
+		}
+		defer errs.DeadLetter.Close()
+	}
+
+	var checkpoints importer.Checkpoints
+	if *checkpointDir != "" {
+		st := store.New()
+		close := st.Connect(*checkpointDir)
+		defer close()
+		checkpoints = st
+	}
+
+	s, err := elastic.Index(elastic.IndexArgs{
 		Dir:          *itemsDir,
 		PrefixFilter: *prefixFilter,
 		Max:          *max,
 		BatchSize:    *batchSize,
 		ConvertIDs:   db.IDs,
+		Errors:       errs,
+		Workers:      *workers,
+		Consumers:    *consumers,
+		Unordered:    *unordered,
+		Checkpoints:  checkpoints,
+		Resume:       *resume,
 	})
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range s.Errors {
+		fmt.Printf("WARN: skipped %s\n", e)
+	}
 
 	// res, err := elastic.Query(elastic.QueryArgs{
 	// 	C: &elastic.Conditions{
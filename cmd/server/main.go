@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/anrid/attribute-filters/pkg/attribute"
+	"github.com/anrid/attribute-filters/pkg/server"
+	"github.com/spf13/pflag"
+)
+
+func main() {
+	dataDir := pflag.StringP("data", "d", "", "Dir with gzipped CSV files containing exported tables from the Item Attributes Postgres database (e.g. attributes.csv.gz)")
+	categoriesFile := pflag.StringP("cats", "c", "", "Item categories file in JSON format")
+	snapshotFile := pflag.StringP("snapshot", "s", "", "Load the attributes DB from a binary snapshot (see cmd/importer) instead of CSV files")
+	addr := pflag.String("addr", ":8080", "Address to listen on")
+	popularityFile := pflag.String("popularity", "", "CSV file of item attributes to load option popularity from when loading CSV files (see --popularity in cmd/importer)")
+	counts := pflag.Bool("counts", false, "Count items per option using option popularity (stored in the snapshot or loaded with --popularity), e.g. for \"counts\": true search conditions")
+	reloadInterval := pflag.Duration("reload-interval", 0, "Reload the attributes DB at this interval, e.g. 10m (send SIGHUP or POST /v1/reload to reload on demand)")
+
+	pflag.Parse()
+
+	if *snapshotFile == "" && (*dataDir == "" || *categoriesFile == "") {
+		pflag.PrintDefaults()
+		os.Exit(-1)
+	}
+
+	if *counts && *snapshotFile == "" && *popularityFile == "" {
+		fmt.Printf("--counts needs option popularity, pass --popularity or load a snapshot with --snapshot\n")
+		os.Exit(-1)
+	}
+
+	h, err := attribute.NewHolder(func() (*attribute.DB, error) {
+		return loadDB(*snapshotFile, *dataDir, *categoriesFile, *popularityFile)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if *reloadInterval > 0 {
+		go h.ReloadEvery(context.Background(), *reloadInterval)
+	}
+
+	// Reload on SIGHUP
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			h.ReloadInBackground(func(err error) {
+				if err != nil {
+					fmt.Printf("WARN: %s\n", err)
+				}
+			})
+		}
+	}()
+
+	s := server.New(h)
+	if *counts {
+		s.Counter = &attribute.PopularityCounter{}
+	}
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+
+	fmt.Printf("Listening on %s ..\n", *addr)
+
+	err = srv.ListenAndServe()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func loadDB(snapshotFile, dataDir, categoriesFile, popularityFile string) (*attribute.DB, error) {
+	if snapshotFile != "" {
+		f, err := os.Open(snapshotFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return attribute.LoadSnapshot(f)
+	}
+
+	db := attribute.NewDB()
+
+	err := db.LoadCategoriesJSON(categoriesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.ImportPostgresDatabase(attribute.ImportPostgresDatabaseArgs{Dir: dataDir})
+	if err != nil {
+		return nil, err
+	}
+
+	db.PreSort()
+
+	if popularityFile != "" {
+		err = db.LoadOptionPopularityCSV(popularityFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
@@ -4,13 +4,14 @@ import (
 	"compress/gzip"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/anrid/attribute-filters/pkg/importer"
@@ -20,6 +21,14 @@ const (
 	DebugPrint = false
 )
 
+var (
+	ErrUnknownCategory  = errors.New("unknown category")
+	ErrUnknownAttribute = errors.New("unknown attribute")
+	ErrUnknownOption    = errors.New("unknown option")
+	ErrEmptyUUID        = errors.New("empty uuid")
+	ErrInvalidNumber    = errors.New("invalid number")
+)
+
 type DB struct {
 	IDs           map[string]int        `json:"ids"`
 	IDCounter     int                   `json:"id_counter"`
@@ -32,6 +41,15 @@ type DB struct {
 	tmpCategoryAttrRels []*tmpCategoryAttributeRel `json:"-"`
 	tmpDynOptRels       []*tmpDynamicOptionRel     `json:"-"`
 
+	// Rules for categories without rules of their own, resolved on demand
+	inheritedRules   map[int]*CategoryRule `json:"-"` // key = category_id
+	categoryChildren map[int][]int         `json:"-"` // key = parent category_id
+	inheritedRulesMu sync.RWMutex          `json:"-"`
+
+	// Options in alternative sort orders, built on demand
+	optionOrders   map[OptionSort]*optionOrder `json:"-"`
+	optionOrdersMu sync.RWMutex                `json:"-"`
+
 	// This can be used to load the same data over and over
 	// to stresstest the attribute database, e.g. to ensure
 	// that it performs well even with 100x the data loaded.
@@ -47,6 +65,7 @@ func NewDB() *DB {
 	db.CategoryRules = make(map[int]*CategoryRule)
 	db.ReverseIDs = make(map[int]string)
 	db.CategoryTree = make(map[int]*Category)
+	db.inheritedRules = make(map[int]*CategoryRule)
 
 	return db
 }
@@ -84,11 +103,15 @@ func (db *DB) LoadCategoriesJSON(file string) error {
 }
 
 func (db *DB) FullCategoryName(categoryID int) string {
-	c := db.CategoryTree[categoryID]
+	c, found := db.CategoryTree[categoryID]
+	if !found {
+		return fmt.Sprintf("<unknown category %d>", categoryID)
+	}
 	var name []string
 	for _, id := range c.Path {
-		pc := db.CategoryTree[id]
-		name = append(name, pc.Name)
+		if pc, found := db.CategoryTree[id]; found {
+			name = append(name, pc.Name)
+		}
 	}
 	name = append(name, c.Name)
 	return strings.Join(name, " - ")
@@ -99,15 +122,21 @@ func (db *DB) AttributeOptionPairToString(pair string) string {
 	attributeID, _ := strconv.Atoi(parts[0])
 	optionID, _ := strconv.Atoi(parts[1])
 
-	a := db.Attributes[attributeID]
-	o := db.Options[optionID]
+	a, err := db.Attribute(attributeID)
+	if err != nil {
+		return err.Error()
+	}
+	o, err := db.Option(optionID)
+	if err != nil {
+		return err.Error()
+	}
 
 	return a.Title + " - " + o.Title
 }
 
 // Takes a CSV file (gzipped) containing a ItemID->AttributeID->AttributeValue
 // relationships and converts them to use this DB's IDs (integer primary keys).
-func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile string) {
+func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile string) error {
 	start := time.Now()
 
 	fmt.Printf("Relationships CSV file : %s\n", fromGzippedCSVFile)
@@ -115,19 +144,19 @@ func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile st
 
 	fr, err := os.Open(fromGzippedCSVFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer fr.Close()
 
 	fw, err := os.OpenFile(toCSVFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer fw.Close()
 
 	gr, err := gzip.NewReader(fr)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	cr := csv.NewReader(gr)
@@ -136,7 +165,7 @@ func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile st
 
 	err = cw.Write([]string{"item_id", "attribute_to_option_pairs"})
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	var line int
@@ -154,7 +183,7 @@ func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile st
 			if err == io.EOF {
 				break
 			}
-			panic(err)
+			return err
 		}
 		line++
 
@@ -182,9 +211,9 @@ func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile st
 			continue
 		}
 
-		a, found := db.Attributes[attributeID]
-		if !found {
-			log.Panicf("could not find attribute %d\n", attributeID)
+		a, err := db.Attribute(attributeID)
+		if err != nil {
+			return err
 		}
 		if !a.IsSearchable || a.IsDisabled {
 			continue
@@ -214,9 +243,9 @@ func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile st
 			continue
 		}
 
-		o, found := db.Options[optionID]
-		if !found {
-			log.Panicf("could not find option %d\n", optionID)
+		o, err := db.Option(optionID)
+		if err != nil {
+			return err
 		}
 
 		if lastItemID != "" && lastItemID != itemID {
@@ -229,7 +258,7 @@ func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile st
 
 			err = cw.Write([]string{itemID, strings.Join(aoRels, "|")})
 			if err != nil {
-				panic(err)
+				return err
 			}
 
 			items++
@@ -247,6 +276,8 @@ func (db *DB) ConvertItemAttributeRelationships(fromGzippedCSVFile, toCSVFile st
 	fmt.Printf("Read %d records (found %d items and %d attribute_to_option_pairs)\n\n", line, items, attrToOptionPairs)
 	fmt.Printf("Attribute source counts:\n%s\n", ToPrettyJSON(sourceCounts))
 	fmt.Printf("Missing options:\n%s\n\n", ToPrettyJSON(missingOptions))
+
+	return nil
 }
 
 func ToPrettyJSON(o interface{}) string {
@@ -255,65 +286,123 @@ func ToPrettyJSON(o interface{}) string {
 }
 
 type ImportPostgresDatabaseArgs struct {
-	Dir string
+	Dir    string                 // dir with gzipped CSV files, used if no source is given
+	Source importer.Source        // read tables from this source, e.g. a tar archive or embedded test data
+	Errors importer.ErrorHandling // what to do with bad records, fail fast by default
+
+	// Number of files read and decoded in parallel, defaults to one per table
+	Workers int
 }
 
-// Dir contains gzipped CSV of key tables from the Item Attributes database
-// exported from Postgres (each table exported as a separate CSV file).
+// Tables exported from the Item Attributes database, in import order.
+var postgresTables = []struct {
+	name string
+	add  func(db *DB, rec, headers []string) error
+}{
+	{"attribute", (*DB).AddAttribute},
+	{"attribute_option", (*DB).AddOption},
+	{"category_attribute", (*DB).AddCategoryAttribute},
+	{"dynamic_attribute_option", (*DB).AddDynamicOption},
+}
+
+// Imports key tables from the Item Attributes database exported from Postgres
+// (each table exported as a separate file, e.g. attribute.csv.gz). Reads
+// gzipped CSV files in a dir unless given another source.
 func (db *DB) ImportPostgresDatabase(a ImportPostgresDatabaseArgs) error {
 	start := time.Now()
 
-	importer.FromGzippedCSVFiles(importer.FromGzippedCSVFilesArgs{
-		Dir:          a.Dir,
-		PrefixFilter: "attribute.csv.gz",
-		AddFunc:      db.AddAttribute,
-	})
+	src := a.Source
+	if src == nil {
+		src = importer.NewDirSource(a.Dir)
+	}
 
-	importer.FromGzippedCSVFiles(importer.FromGzippedCSVFilesArgs{
-		Dir:          a.Dir,
-		PrefixFilter: "attribute_option.csv.gz",
-		AddFunc:      db.AddOption,
-	})
+	var tables []string
+	adds := make(map[string]importer.AddFunc) // key = table name
+	for _, t := range postgresTables {
+		add := t.add
+		tables = append(tables, t.name)
+		adds[t.name] = func(rec, headers []string) error {
+			return add(db, rec, headers)
+		}
+	}
 
-	importer.FromGzippedCSVFiles(importer.FromGzippedCSVFilesArgs{
-		Dir:          a.Dir,
-		PrefixFilter: "category_attribute.csv.gz",
-		AddFunc:      db.AddCategoryAttribute,
-	})
+	workers := a.Workers
+	if workers == 0 {
+		// Decode all tables at once
+		workers = len(tables)
+	}
 
-	importer.FromGzippedCSVFiles(importer.FromGzippedCSVFilesArgs{
-		Dir:          a.Dir,
-		PrefixFilter: "dynamic_attribute_option.csv.gz",
-		AddFunc:      db.AddDynamicOption,
+	// Records are added in table order, so IDs are assigned the same way
+	// however many workers read the tables
+	s, err := importer.FromSource(importer.FromSourceArgs{
+		Source:   src,
+		Tables:   tables,
+		AddFuncs: adds,
+		Errors:   a.Errors,
+		Workers:  workers,
 	})
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	for _, t := range tables {
+		if s.Tables[t] == 0 {
+			fmt.Printf("WARN: no records found for table %s\n", t)
+		}
+	}
 
 	fmt.Printf("Finished loading data in %s\n", time.Since(start))
 
 	return db.PostProcessImportedData()
 }
 
-func (db *DB) Attribute(id int) *Attribute {
+func (db *DB) Attribute(id int) (*Attribute, error) {
 	a, found := db.Attributes[id]
 	if !found {
-		log.Panicf("could not find attribute %d (uuid: %s)", id, db.ReverseIDs[id])
+		return nil, fmt.Errorf("%w: %d (uuid: %s)", ErrUnknownAttribute, id, db.ReverseIDs[id])
 	}
-	return a
+	return a, nil
 }
 
-func (db *DB) Option(id int) *Option {
+func (db *DB) Option(id int) (*Option, error) {
 	o, found := db.Options[id]
 	if !found {
-		log.Panicf("could not find option %d (uuid: %s)", id, db.ReverseIDs[id])
+		return nil, fmt.Errorf("%w: %d (uuid: %s)", ErrUnknownOption, id, db.ReverseIDs[id])
 	}
-	return o
+	return o, nil
 }
 
-func (db *DB) CategoryRule(categoryID int) *CategoryRule {
+// Returns the rule for the given category. Categories without a rule of their
+// own inherit one from the category tree, see inheritCategoryRule.
+func (db *DB) CategoryRule(categoryID int) (*CategoryRule, error) {
 	r, found := db.CategoryRules[categoryID]
+	if found {
+		return r, nil
+	}
+
+	db.inheritedRulesMu.RLock()
+	r, found = db.inheritedRules[categoryID]
+	db.inheritedRulesMu.RUnlock()
+	if found {
+		return r, nil
+	}
+
+	c, found := db.CategoryTree[categoryID]
 	if !found {
-		log.Panicf("could not find rule for category %d", categoryID)
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCategory, categoryID)
+	}
+
+	db.inheritedRulesMu.Lock()
+	defer db.inheritedRulesMu.Unlock()
+
+	if db.inheritedRules == nil {
+		db.inheritedRules = make(map[int]*CategoryRule)
 	}
-	return r
+	if r, found = db.inheritedRules[categoryID]; !found {
+		r = db.inheritCategoryRule(c)
+		db.inheritedRules[categoryID] = r
+	}
+
+	return r, nil
 }
 
 func (db *DB) PostProcessImportedData() error {
@@ -326,8 +415,21 @@ func (db *DB) PostProcessImportedData() error {
 
 	// Create references between attributes and options
 	for _, o := range db.Options {
-		a := db.Attribute(o.AttributeID)
+		a, err := db.Attribute(o.AttributeID)
+		if err != nil {
+			return fmt.Errorf("option %d: %w", o.ID, err)
+		}
 		a.OptionIDs = append(a.OptionIDs, o.ID)
+
+		// Used when filtering options and rendering swatches
+		o.foldText()
+		o.parseColor()
+	}
+
+	// Options are added in map order, sort them so that results are
+	// the same between runs
+	for _, a := range db.Attributes {
+		db.sortOptionIDs(a.OptionIDs)
 	}
 
 	// Create category rules.
@@ -338,7 +440,10 @@ func (db *DB) PostProcessImportedData() error {
 			continue
 		}
 
-		a := db.Attribute(r.AttributeID)
+		a, err := db.Attribute(r.AttributeID)
+		if err != nil {
+			return fmt.Errorf("category %d: %w", r.CategoryID, err)
+		}
 
 		rule, found := db.CategoryRules[r.CategoryID]
 		if !found {
@@ -359,8 +464,16 @@ func (db *DB) PostProcessImportedData() error {
 			continue
 		}
 
-		o := db.Option(r.OptionID)
-		rule := db.CategoryRule(r.CategoryID)
+		o, err := db.Option(r.OptionID)
+		if err != nil {
+			return fmt.Errorf("dynamic_attribute_option %s: %w", r.OriginalUUID, err)
+		}
+
+		// Must be the category's own rule, never an inherited one
+		rule, found := db.CategoryRules[r.CategoryID]
+		if !found {
+			return fmt.Errorf("dynamic_attribute_option %s: %w: %d has no attributes", r.OriginalUUID, ErrUnknownCategory, r.CategoryID)
+		}
 
 		if len(r.Precondition) < 3 {
 			// No precondition, this option is always visible
@@ -410,7 +523,10 @@ func (db *DB) PostProcessImportedData() error {
 					}
 				}
 
-				pcID := db.ConvertID(pcUUID)
+				pcID, err := db.ConvertID(pcUUID)
+				if err != nil {
+					return err
+				}
 
 				if pcA, found := db.Attributes[pcID]; found {
 					// Precondition is an attribute
@@ -436,6 +552,12 @@ func (db *DB) PostProcessImportedData() error {
 	// Determine which attributes show always be visible for each
 	// category rule
 	for _, rule := range db.CategoryRules {
+		for _, los := range rule.ShowIfOptionIDSelected {
+			for _, lo := range los {
+				db.sortOptionIDs(lo.OptionIDs)
+			}
+		}
+
 		// Get all attributes with options that can get limited (hidden)
 		// when a certain options are selected
 		limitedAttributeIDs := make(map[int]bool)
@@ -457,118 +579,197 @@ func (db *DB) PostProcessImportedData() error {
 	db.tmpCategoryAttrRels = nil
 	db.tmpDynOptRels = nil
 
+	// Rules inherited by categories without rules of their own
+	// must be resolved again
+	db.inheritedRulesMu.Lock()
+	db.inheritedRules = make(map[int]*CategoryRule)
+	db.categoryChildren = nil
+	db.inheritedRulesMu.Unlock()
+
+	db.optionOrdersMu.Lock()
+	db.optionOrders = nil
+	db.optionOrdersMu.Unlock()
+
 	fmt.Printf("Finished post-processing data in %s\n", time.Since(start))
 
 	return nil
 }
 
+// Columns of the exported tables, in export order.
+var (
+	attributeSchema = importer.NewSchema("attribute",
+		importer.Required("attribute_id"),        // 754abe74-304e-4925-b61a-52aa58eb8153
+		importer.Required("attribute_type"),      // enum
+		importer.Required("is_multiple_allowed"), // f
+		importer.Required("is_required"),         // f
+		importer.Required("is_disabled"),         // f
+		importer.Required("title"),               // ヒール高さ
+		importer.Required("display_order"),       // 3
+		importer.Optional("created_at"),          // 2023-04-24 03:01:33.473284+00
+		importer.Optional("updated_at"),          // 2023-06-06 04:16:32.368978+00
+		importer.Required("searchable"),          // f
+		importer.Required("listing_type"),        // single_select
+		importer.Required("display_page"),        // 2
+	)
+	optionSchema = importer.NewSchema("attribute_option",
+		importer.Required("attribute_option_id"), // 3ce5f8be-4b0a-45bf-a44e-9f90aab5edc3
+		importer.Required("attribute_id"),        // 1dda946b-44b9-46a7-aec6-abc4a1ee3f26
+		importer.Required("title"),               // S 拡張パック 漆黒のガイスト
+		importer.Required("is_disabled"),         // f
+		importer.Required("display_order"),       // 8
+		importer.Optional("created_at"),          // 2023-04-24 03:01:33.473284+00
+		importer.Optional("updated_at"),          // 2023-05-22 07:18:16.318604+00
+		importer.Optional("color"),               // {"red":0,"green":0,"blue":0}
+		importer.Optional("subtitle"),            //
+	)
+	categoryAttributeSchema = importer.NewSchema("category_attribute",
+		importer.Required("category_attribute_id"), // 4da81626-45ae-4106-b450-0262e1a1fcd5
+		importer.Required("category_id"),           // 135
+		importer.Required("attribute_id"),          // b6b9be89-648c-4af9-b3fe-1b77de4833d1
+		importer.Required("is_disabled"),           // f
+		importer.Optional("created_at"),            // 2023-04-24 03:01:33.473284+00
+		importer.Optional("updated_at"),            // 2023-04-24 03:01:33.473284+00
+	)
+	dynamicOptionSchema = importer.NewSchema("dynamic_attribute_option",
+		importer.Required("dynamic_attribute_option_id"), // 6d94fa0b-653e-4ceb-bb98-d2becfc9caa6
+		importer.Required("category_id"),                 // 179
+		importer.Required("attribute_option_id"),         // a4bf6fbb-4fd4-4417-bd62-cb05629c9b31
+		importer.Required("precondition"),                // {5508f4a4-7369-4993-904f-7fab6ae31305}
+		importer.Required("is_disabled"),                 // f
+		importer.Optional("created_at"),                  // 2023-09-11 02:33:17.06964+00
+		importer.Optional("updated_at"),                  // 2023-09-11 02:33:17.06964+00
+	)
+)
+
+// Adds an attribute record (7742 records in the test data), see
+// attributeSchema. Records without headers are expected in export order.
 func (db *DB) AddAttribute(rec, headers []string) error {
-	// - 00  attribute_id                              : 754abe74-304e-4925-b61a-52aa58eb8153
-	// - 01  attribute_type                            : enum
-	// - 02  is_multiple_allowed                       : f
-	// - 03  is_required                               : f
-	// - 04  is_disabled                               : f
-	// - 05  title                                     : ヒール高さ
-	// - 06  display_order                             : 3
-	// - 07  created_at                                : 2023-04-24 03:01:33.473284+00
-	// - 08  updated_at                                : 2023-06-06 04:16:32.368978+00
-	// - 09  searchable                                : f
-	// - 10  listing_type                              : single_select
-	// - 11  display_page                              : 2
-	// - records: 7742
+	r, err := attributeSchema.Record(rec, headers)
+	if err != nil {
+		return err
+	}
+
 	o := new(Attribute)
 
-	o.ID = db.ConvertID(rec[0])
-	o.Type = rec[1]
-	if rec[2] == "t" {
+	id := r.Get("attribute_id")
+	o.ID, err = db.ConvertID(id)
+	if err != nil {
+		return fmt.Errorf("attribute: %w", err)
+	}
+	o.Type = r.Get("attribute_type")
+	if r.Get("is_multiple_allowed") == "t" {
 		o.IsMultipleAllowed = true
 	}
-	if rec[3] == "t" {
+	if r.Get("is_required") == "t" {
 		o.IsRequired = true
 	}
-	if rec[4] == "t" {
+	if r.Get("is_disabled") == "t" {
 		o.IsDisabled = true
 	}
-	o.Title = rec[5]
-	if rec[6] != "" {
-		o.DisplayOrder = atoi(rec[6])
+	o.Title = r.Get("title")
+	if v := r.Get("display_order"); v != "" {
+		o.DisplayOrder, err = atoi(v)
+		if err != nil {
+			return fmt.Errorf("attribute %s display_order: %w", id, err)
+		}
 	}
-	if rec[9] == "t" {
+	if r.Get("searchable") == "t" {
 		o.IsSearchable = true
 	}
-	o.ListingType = rec[10]
-	o.DisplayPage = atoi(rec[11])
+	o.ListingType = r.Get("listing_type")
+	o.DisplayPage, err = atoi(r.Get("display_page"))
+	if err != nil {
+		return fmt.Errorf("attribute %s display_page: %w", id, err)
+	}
 
 	db.Attributes[o.ID] = o
 
 	return nil
 }
 
+// Adds an attribute option record (173820 records in the test data), see
+// optionSchema.
 func (db *DB) AddOption(rec, headers []string) error {
-	// - 00  attribute_option_id                       : 3ce5f8be-4b0a-45bf-a44e-9f90aab5edc3
-	// - 01  attribute_id                              : 1dda946b-44b9-46a7-aec6-abc4a1ee3f26
-	// - 02  title                                     : S 拡張パック 漆黒のガイスト
-	// - 03  is_disabled                               : f
-	// - 04  display_order                             : 8
-	// - 05  created_at                                : 2023-04-24 03:01:33.473284+00
-	// - 06  updated_at                                : 2023-05-22 07:18:16.318604+00
-	// - 07  color                                     : {"red":0,"green":0,"blue":0}
-	// - 08  subtitle                                  :
-	// - records: 173820
+	r, err := optionSchema.Record(rec, headers)
+	if err != nil {
+		return err
+	}
+
 	o := new(Option)
 
-	o.ID = db.ConvertID(rec[0])
+	id := r.Get("attribute_option_id")
+	o.ID, err = db.ConvertID(id)
+	if err != nil {
+		return fmt.Errorf("attribute_option: %w", err)
+	}
 
-	if rec[1] == "0" || rec[1] == "" {
+	attributeID := r.Get("attribute_id")
+	if attributeID == "0" || attributeID == "" {
 		if DebugPrint {
-			fmt.Printf("WARN: empty attribute_id for attribute_option %s - skipping!\n", rec[0])
+			fmt.Printf("WARN: empty attribute_id for attribute_option %s - skipping!\n", id)
 		}
 		return nil
 	}
-	o.AttributeID = db.ConvertID(rec[1])
+	o.AttributeID, err = db.ConvertID(attributeID)
+	if err != nil {
+		return fmt.Errorf("attribute_option %s attribute_id: %w", id, err)
+	}
 
-	o.Title = rec[2]
-	if rec[3] == "t" {
+	o.Title = r.Get("title")
+	if r.Get("is_disabled") == "t" {
 		o.IsDisabled = true
 	}
-	if rec[4] != "" {
-		o.DisplayOrder = atoi(rec[4])
+	if v := r.Get("display_order"); v != "" {
+		o.DisplayOrder, err = atoi(v)
+		if err != nil {
+			return fmt.Errorf("attribute_option %s display_order: %w", id, err)
+		}
 	}
-	o.Color = rec[7]
-	o.Subtitle = rec[8]
+	o.Color = r.Get("color")
+	o.Subtitle = r.Get("subtitle")
 
 	db.Options[o.ID] = o
 
 	return nil
 }
 
+// Adds a category attribute record (8978 records in the test data), see
+// categoryAttributeSchema.
 func (db *DB) AddCategoryAttribute(rec, headers []string) error {
-	// - 00  category_attribute_id                     : 4da81626-45ae-4106-b450-0262e1a1fcd5
-	// - 01  category_id                               : 135
-	// - 02  attribute_id                              : b6b9be89-648c-4af9-b3fe-1b77de4833d1
-	// - 03  is_disabled                               : f
-	// - 04  created_at                                : 2023-04-24 03:01:33.473284+00
-	// - 05  updated_at                                : 2023-04-24 03:01:33.473284+00
-	// - records: 8978
+	r, err := categoryAttributeSchema.Record(rec, headers)
+	if err != nil {
+		return err
+	}
+
 	o := new(tmpCategoryAttributeRel)
 
-	if rec[1] == "0" || rec[1] == "" {
+	id := r.Get("category_attribute_id")
+
+	categoryID := r.Get("category_id")
+	if categoryID == "0" || categoryID == "" {
 		if DebugPrint {
-			fmt.Printf("WARN: empty category_id for category_attribute %s - skipping!\n", rec[0])
+			fmt.Printf("WARN: empty category_id for category_attribute %s - skipping!\n", id)
 		}
 		return nil
 	}
-	o.CategoryID = atoi(rec[1]) // category id is already an int!
+	o.CategoryID, err = atoi(categoryID) // category id is already an int!
+	if err != nil {
+		return fmt.Errorf("category_attribute %s category_id: %w", id, err)
+	}
 
-	if rec[2] == "0" || rec[2] == "" {
+	attributeID := r.Get("attribute_id")
+	if attributeID == "0" || attributeID == "" {
 		if DebugPrint {
-			fmt.Printf("WARN: empty attribute_id for category_attribute %s - skipping!\n", rec[0])
+			fmt.Printf("WARN: empty attribute_id for category_attribute %s - skipping!\n", id)
 		}
 		return nil
 	}
-	o.AttributeID = db.ConvertID(rec[2])
+	o.AttributeID, err = db.ConvertID(attributeID)
+	if err != nil {
+		return fmt.Errorf("category_attribute %s attribute_id: %w", id, err)
+	}
 
-	if rec[3] == "t" {
+	if r.Get("is_disabled") == "t" {
 		o.IsDisabled = true
 	}
 
@@ -577,48 +778,57 @@ func (db *DB) AddCategoryAttribute(rec, headers []string) error {
 	return nil
 }
 
+// Adds a dynamic attribute option record (73673 records in the test data),
+// see dynamicOptionSchema.
 func (db *DB) AddDynamicOption(rec, headers []string) error {
-	// - 00  dynamic_attribute_option_id               : 6d94fa0b-653e-4ceb-bb98-d2becfc9caa6
-	// - 01  category_id                               : 179
-	// - 02  attribute_option_id                       : a4bf6fbb-4fd4-4417-bd62-cb05629c9b31
-	// - 03  precondition                              : {5508f4a4-7369-4993-904f-7fab6ae31305}
-	// - 04  is_disabled                               : f
-	// - 05  created_at                                : 2023-09-11 02:33:17.06964+00
-	// - 06  updated_at                                : 2023-09-11 02:33:17.06964+00
-	// - records: 73673
+	r, err := dynamicOptionSchema.Record(rec, headers)
+	if err != nil {
+		return err
+	}
+
 	o := new(tmpDynamicOptionRel)
 
-	if rec[1] == "0" || rec[1] == "" {
+	id := r.Get("dynamic_attribute_option_id")
+
+	categoryID := r.Get("category_id")
+	if categoryID == "0" || categoryID == "" {
 		if DebugPrint {
-			fmt.Printf("WARN: empty category_id for dynamic_attribute_option %s - skipping!\n", rec[0])
+			fmt.Printf("WARN: empty category_id for dynamic_attribute_option %s - skipping!\n", id)
 		}
 		return nil
 	}
-	o.CategoryID = atoi(rec[1]) // category id is already an int!
+	o.CategoryID, err = atoi(categoryID) // category id is already an int!
+	if err != nil {
+		return fmt.Errorf("dynamic_attribute_option %s category_id: %w", id, err)
+	}
 
-	if rec[2] == "0" || rec[2] == "" {
+	optionID := r.Get("attribute_option_id")
+	if optionID == "0" || optionID == "" {
 		if DebugPrint {
-			fmt.Printf("WARN: empty attribute_option_id for dynamic_attribute_option %s - skipping!\n", rec[0])
+			fmt.Printf("WARN: empty attribute_option_id for dynamic_attribute_option %s - skipping!\n", id)
 		}
 		return nil
 	}
-	o.OptionID = db.ConvertID(rec[2]) // can be empty!
+	o.OptionID, err = db.ConvertID(optionID) // can be empty!
+	if err != nil {
+		return fmt.Errorf("dynamic_attribute_option %s attribute_option_id: %w", id, err)
+	}
 
-	o.Precondition = rec[3]
-	if rec[4] == "t" {
+	o.Precondition = r.Get("precondition")
+	if r.Get("is_disabled") == "t" {
 		o.IsDisabled = true
 	}
 
-	o.OriginalUUID = rec[0] // To help with debugging / validation
+	o.OriginalUUID = id // To help with debugging / validation
 
 	db.tmpDynOptRels = append(db.tmpDynOptRels, o)
 
 	return nil
 }
 
-func (db *DB) ConvertID(uuid string) (id int) {
+func (db *DB) ConvertID(uuid string) (id int, err error) {
 	if uuid == "" {
-		log.Panicln("got empty uuid")
+		return 0, ErrEmptyUUID
 	}
 	if db.appendSuffixToConvertedKeys != "" {
 		uuid += db.appendSuffixToConvertedKeys
@@ -642,41 +852,51 @@ func (db *DB) PreSort() {
 
 	// Sort attributes by display order for all category rules
 	for _, rule := range db.CategoryRules {
-		if len(rule.AttributeIDs) > 1 {
-			sort.SliceStable(rule.AttributeIDs, func(i, j int) bool {
-				a1 := db.Attribute(rule.AttributeIDs[i])
-				a2 := db.Attribute(rule.AttributeIDs[j])
-				return a1.DisplayOrder < a2.DisplayOrder
-			})
-		}
-
-		if len(rule.AlwaysVisibleAttributeIDs) > 1 {
-			sort.SliceStable(rule.AlwaysVisibleAttributeIDs, func(i, j int) bool {
-				a1 := db.Attribute(rule.AlwaysVisibleAttributeIDs[i])
-				a2 := db.Attribute(rule.AlwaysVisibleAttributeIDs[j])
-				return a1.DisplayOrder < a2.DisplayOrder
-			})
-		}
+		db.sortAttributeIDs(rule.AttributeIDs)
+		db.sortAttributeIDs(rule.AlwaysVisibleAttributeIDs)
 
-		// For each attribute, sort attribute options by display order
-		// for _, id := range rule.AttributeIDs {
-		// 	if len(a.Options) > 1 {
-		// 		sort.SliceStable(a.Options, func(i, j int) bool {
-		// 			return a.Options[i].DisplayOrder < a.Options[j].DisplayOrder
-		// 		})
-		// 	}
-		// }
+		// Options are already sorted by display order when post-processing
+		// imported data, see also OptionSort
 	}
 
 	fmt.Printf("Finished pre-sorting data in %s\n", time.Since(start))
 }
 
-func atoi(n string) int {
+// Sorts attribute IDs the way they're shown in the listing form, see
+// attributeLess.
+func (db *DB) sortAttributeIDs(ids []int) {
+	if len(ids) > 1 {
+		sort.SliceStable(ids, func(i, j int) bool {
+			return db.attributeLess(ids[i], ids[j])
+		})
+	}
+}
+
+// Orders attributes by display page, then display order, then ID.
+// Unknown attributes go last.
+func (db *DB) attributeLess(id1, id2 int) bool {
+	a1, a2 := db.Attributes[id1], db.Attributes[id2]
+	if a1 == nil || a2 == nil {
+		if a1 == nil && a2 == nil {
+			return id1 < id2
+		}
+		return a2 == nil
+	}
+	if a1.DisplayPage != a2.DisplayPage {
+		return a1.DisplayPage < a2.DisplayPage
+	}
+	if a1.DisplayOrder != a2.DisplayOrder {
+		return a1.DisplayOrder < a2.DisplayOrder
+	}
+	return a1.ID < a2.ID
+}
+
+func atoi(n string) (int, error) {
 	i, err := strconv.Atoi(n)
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("%w: '%s'", ErrInvalidNumber, n)
 	}
-	return i
+	return i, nil
 }
 
 type Attribute struct {
@@ -701,6 +921,11 @@ type Option struct {
 	DisplayOrder int
 	Color        string
 	Subtitle     string
+	Popularity   int  // e.g. number of items using this option, see SetOptionPopularity
+	RGB          *RGB // parsed Color, nil if empty or invalid
+
+	foldedTitle    string
+	foldedSubtitle string
 }
 
 type CategoryRule struct {
@@ -1,7 +1,21 @@
 package attribute
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+
+	"github.com/anrid/attribute-filters/pkg/importer"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -73,10 +87,13 @@ var _ = Describe("Importing attributes database", Label("attributes"), func() {
 
 			rule := db.CategoryRules[categoryID]
 
+			// Must be selectable without selecting anything else first
 			var requiredOptionID int
 			for id := range rule.ShowIfOptionIDSelected {
-				requiredOptionID = id
-				break
+				if o, found := db.Options[id]; found && rule.isAlwaysVisible(o.AttributeID) && !o.IsDisabled {
+					requiredOptionID = id
+					break
+				}
 			}
 
 			requiredOption, found := db.Options[requiredOptionID]
@@ -91,5 +108,1327 @@ var _ = Describe("Importing attributes database", Label("attributes"), func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(len(res.VAs)).To(BeNumerically(">", len(baseCase.VAs)))
 		})
+
+		It("should order always visible and revealed attributes like the listing form", func() {
+			sc := &SearchConditions{CategoryIDs: []int{categoryID}}
+			for selectedOptionID := range db.CategoryRules[categoryID].ShowIfOptionIDSelected {
+				if o, found := db.Options[selectedOptionID]; found {
+					sc.Attributes = append(sc.Attributes, &AttributeCondition{AttributeID: o.AttributeID, OptionID: o.ID})
+				}
+			}
+
+			res, err := FindVisibleAttributes(sc, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(res.VAs)).To(BeNumerically(">", 1))
+
+			for i := 1; i < len(res.VAs); i++ {
+				prev, a := db.Attributes[res.VAs[i-1].ID], db.Attributes[res.VAs[i].ID]
+				Expect([]int{prev.DisplayPage, prev.DisplayOrder, prev.ID}).To(Satisfy(func(p []int) bool {
+					return p[0] < a.DisplayPage ||
+						(p[0] == a.DisplayPage && p[1] < a.DisplayOrder) ||
+						(p[0] == a.DisplayPage && p[1] == a.DisplayOrder && p[2] < a.ID)
+				}))
+			}
+
+			for i := 0; i < 5; i++ {
+				again, err := FindVisibleAttributes(sc, db)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(again.VAs).To(Equal(res.VAs))
+			}
+		})
+	})
+
+	When("attributes or options are disabled", func() {
+		// Find a disabled option of an always visible attribute
+		findDisabled := func() *Option {
+			for _, id := range db.CategoryRules[categoryID].AlwaysVisibleAttributeIDs {
+				a, err := db.Attribute(id)
+				Expect(err).ToNot(HaveOccurred())
+				for _, optionID := range a.OptionIDs {
+					if o := db.Options[optionID]; o.IsDisabled {
+						return o
+					}
+				}
+			}
+			return nil
+		}
+
+		It("should hide disabled options and remove them from search conditions", func() {
+			disabled := findDisabled()
+			if disabled == nil {
+				Skip("no disabled options in category")
+			}
+
+			sc := &SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes:  []*AttributeCondition{{AttributeID: disabled.AttributeID, OptionID: disabled.ID}},
+				PageSize:    1_000,
+				Filters:     []*OptionFilter{{AttributeID: disabled.AttributeID, Query: disabled.Title}},
+			}
+
+			res, err := FindVisibleAttributes(sc, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.Attributes).To(BeEmpty())
+			Expect(res.Removed).To(HaveLen(1))
+			Expect(res.Removed[0].Reason).To(Equal(RemovedDisabled))
+			Expect(res.Removed[0].AttributeTitle).To(Equal(db.Attributes[disabled.AttributeID].Title))
+			Expect(res.Removed[0].OptionTitle).To(Equal(disabled.Title))
+			for _, va := range res.VAs {
+				for _, vo := range va.Os {
+					Expect(vo.ID).ToNot(Equal(disabled.ID))
+				}
+			}
+
+			sc.IncludeDisabled = true
+			res, err = FindVisibleAttributes(sc, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.Attributes).To(HaveLen(1))
+		})
+	})
+
+	When("search conditions contain unknown IDs", func() {
+		It("should return an error for unknown categories", func() {
+			_, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{-1},
+			}, db)
+			Expect(err).To(MatchError(ErrUnknownCategory))
+		})
+
+		It("should drop unknown attributes and options", func() {
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes: []*AttributeCondition{
+					{AttributeID: -1, OptionID: -1},
+				},
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.Attributes).To(BeEmpty())
+			Expect(res.Removed).To(Equal([]*RemovedCondition{
+				{AttributeID: -1, OptionID: -1, Reason: RemovedUnknownAttribute},
+			}))
+		})
+
+		It("should drop unknown UUIDs before deduping selections", func() {
+			tdb := newTestDB()
+			tdb.attribute(1, "ブランド", false)
+			tdb.option(11, 1, "ブランドA")
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+
+			selected := []*AttributeCondition{
+				// A bad option doesn't keep the valid one from being
+				// selected in a single-select attribute
+				{AttributeUUID: testUUID(1), OptionUUID: testUUID(999_999)},
+				{AttributeUUID: testUUID(1), OptionUUID: testUUID(11)},
+				// Unknown attributes aren't duplicates of each other
+				{AttributeUUID: testUUID(999_998), OptionUUID: testUUID(11)},
+				{AttributeUUID: testUUID(999_997), OptionUUID: testUUID(11)},
+			}
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{testCategoryID},
+				Attributes:  selected,
+			}, tdb.DB)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.Attributes).To(HaveLen(1))
+			Expect(res.Corrected.Attributes[0].OptionUUID).To(Equal(testUUID(11)))
+
+			var reasons []RemovalReason
+			for _, rc := range res.Removed {
+				reasons = append(reasons, rc.Reason)
+			}
+			Expect(reasons).To(Equal([]RemovalReason{RemovedOptionNotVisible, RemovedUnknownAttribute, RemovedUnknownAttribute}))
+
+			v, err := tdb.ValidateListing(testCategoryID, selected)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(v.Valid).To(BeFalse())
+			var errs []string
+			for _, fe := range v.Errors {
+				errs = append(errs, fe.AttributeUUID+" "+string(fe.Error))
+			}
+			Expect(errs).To(Equal([]string{
+				testUUID(1) + " not_visible",
+				testUUID(999_998) + " unknown_attribute",
+				testUUID(999_997) + " unknown_attribute",
+			}))
+		})
+
+		It("should drop attributes the category doesn't use", func() {
+			rule := db.CategoryRules[categoryID]
+
+			var other *Attribute
+			for _, a := range db.Attributes {
+				if !containsInt(rule.AttributeIDs, a.ID) && len(a.OptionIDs) > 0 {
+					other = a
+					break
+				}
+			}
+			if other == nil {
+				Skip("category uses all attributes")
+			}
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes: []*AttributeCondition{
+					{AttributeID: other.ID, OptionID: other.OptionIDs[0]},
+				},
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.Attributes).To(BeEmpty())
+			Expect(res.Removed).To(HaveLen(1))
+			Expect(res.Removed[0].Reason).To(Equal(RemovedAttributeNotInCategory))
+			Expect(res.Removed[0].AttributeTitle).To(Equal(other.Title))
+		})
+
+		It("should return errors when looking up unknown attributes and options", func() {
+			_, err := db.Attribute(-1)
+			Expect(err).To(MatchError(ErrUnknownAttribute))
+			_, err = db.Option(-1)
+			Expect(err).To(MatchError(ErrUnknownOption))
+			_, err = db.ConvertID("")
+			Expect(err).To(MatchError(ErrEmptyUUID))
+		})
+	})
+
+	When("paginating options", func() {
+		It("should return the next page of options for an attribute when given its cursor", func() {
+			page1, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				PageSize:    10,
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+
+			// Brands have lots of options
+			var va1 *VisibleAttribute
+			for _, va := range page1.VAs {
+				if va.NextCursor != "" {
+					va1 = va
+					break
+				}
+			}
+			Expect(va1).ToNot(BeNil())
+			Expect(va1.Os).To(HaveLen(10))
+
+			page2, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				PageSize:    10,
+				Cursors:     []string{va1.NextCursor},
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(page2.VAs).To(HaveLen(len(page1.VAs)))
+
+			for i, va2 := range page2.VAs {
+				if va2.ID != va1.ID {
+					// Other attributes stay on the first page
+					Expect(va2.Os).To(Equal(page1.VAs[i].Os))
+					continue
+				}
+				Expect(va2.Os).To(HaveLen(10))
+				Expect(va2.Os[0].ID).ToNot(Equal(va1.Os[0].ID))
+				Expect(va2.NextCursor).ToNot(Equal(va1.NextCursor))
+
+				a, err := db.Attribute(va1.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(va2.Os[0].ID).To(Equal(a.OptionIDs[10]))
+			}
+		})
+
+		It("should reject invalid cursors", func() {
+			_, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Cursors:     []string{"not-a-cursor"},
+			}, db)
+			Expect(err).To(MatchError(ErrInvalidCursor))
+
+			_, err = FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Cursors:     []string{EncodeCursor(testUUID(999_999), 10)},
+			}, db)
+			Expect(err).To(MatchError(ErrInvalidCursor))
+
+			_, err = FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Cursors:     []string{EncodeCursor("999999", 10)},
+			}, db)
+			Expect(err).To(MatchError(ErrInvalidCursor))
+		})
+
+		It("should reject negative offsets and page sizes", func() {
+			_, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Offset:      -1,
+			}, db)
+			Expect(err).To(MatchError(ErrInvalidOffset))
+
+			_, err = FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				PageSize:    -1,
+			}, db)
+			Expect(err).To(MatchError(ErrInvalidPageSize))
+		})
+	})
+
+	When("selecting options by UUID", func() {
+		It("should accept and return UUIDs", func() {
+			// Any option of an always visible attribute revealing other
+			// options will do
+			rule := db.CategoryRules[categoryID]
+			var o *Option
+			for _, attributeID := range rule.AlwaysVisibleAttributeIDs {
+				for _, optionID := range db.Attributes[attributeID].OptionIDs {
+					if _, found := rule.ShowIfOptionIDSelected[optionID]; found && o == nil && !db.Options[optionID].IsDisabled {
+						o = db.Options[optionID]
+					}
+				}
+			}
+			Expect(o).ToNot(BeNil())
+
+			byID, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes:  []*AttributeCondition{{AttributeID: o.AttributeID, OptionID: o.ID}},
+				PageSize:    10,
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+
+			byUUID, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes:  []*AttributeCondition{{AttributeUUID: db.UUID(o.AttributeID), OptionUUID: db.UUID(o.ID)}},
+				Filters:     []*OptionFilter{{AttributeUUID: db.UUID(o.AttributeID), Prefix: o.Title}},
+				PageSize:    10,
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(byUUID.Removed).To(BeEmpty())
+			Expect(byUUID.Corrected.Attributes).To(Equal(byID.Corrected.Attributes))
+			Expect(byUUID.Corrected.Filters[0].AttributeID).To(Equal(o.AttributeID))
+			Expect(byUUID.VAs).To(HaveLen(len(byID.VAs)))
+
+			for _, va := range byUUID.VAs {
+				Expect(va.UUID).To(Equal(db.ReverseIDs[va.ID]))
+				for _, vo := range va.Os {
+					Expect(vo.UUID).To(Equal(db.ReverseIDs[vo.ID]))
+				}
+				if va.NextCursor != "" {
+					attributeUUID, _, err := DecodeCursor(va.NextCursor)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(attributeUUID).To(Equal(va.UUID))
+				}
+			}
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes:  []*AttributeCondition{{AttributeUUID: db.UUID(o.AttributeID), OptionUUID: testUUID(999_999)}},
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.Attributes).To(BeEmpty())
+			Expect(res.Removed).To(HaveLen(1))
+			Expect(res.Removed[0].OptionUUID).To(Equal(testUUID(999_999)))
+			Expect(res.Removed[0].Reason).To(Equal(RemovedOptionNotVisible))
+
+			// Explanations refer to unknown selections by the UUID passed
+			res, err = FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes:  []*AttributeCondition{{AttributeUUID: testUUID(999_999), OptionUUID: testUUID(999_998)}},
+				Explain:     true,
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Removed).To(HaveLen(1))
+			Expect(res.Removed[0].Reason).To(Equal(RemovedUnknownAttribute))
+			Expect(res.Removed[0].Explanation.Message).To(ContainSubstring(testUUID(999_999)))
+
+			// Filters can't silently apply to nothing
+			_, err = FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Filters:     []*OptionFilter{{AttributeUUID: testUUID(999_999), Prefix: o.Title}},
+			}, db)
+			Expect(err).To(MatchError(ErrInvalidFilter))
+
+			_, err = FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Filters:     []*OptionFilter{{AttributeID: 999_999, Prefix: o.Title}},
+			}, db)
+			Expect(err).To(MatchError(ErrInvalidFilter))
+		})
+	})
+
+	When("filtering options", func() {
+		findByTitle := func(title string, vas []*VisibleAttribute) *VisibleAttribute {
+			for _, va := range vas {
+				if va.Title == title {
+					return va
+				}
+			}
+			return nil
+		}
+
+		It("should match brands regardless of kana type, width and case", func() {
+			base, err := FindVisibleAttributes(&SearchConditions{CategoryIDs: []int{categoryID}}, db)
+			Expect(err).ToNot(HaveOccurred())
+			brand := findByTitle("ブランド", base.VAs)
+			Expect(brand).ToNot(BeNil())
+
+			for _, f := range []*OptionFilter{
+				{AttributeID: brand.ID, Query: "しゃねる", Fold: true},
+				{AttributeID: brand.ID, Query: "ｼｬﾈﾙ", Fold: true},
+				{AttributeID: brand.ID, Query: "ャネ", Match: MatchContains, Fold: true},
+				{AttributeID: brand.ID, Query: "ｃｈａｎｅｌ", Fold: true, Subtitle: true},
+			} {
+				res, err := FindVisibleAttributes(&SearchConditions{
+					CategoryIDs: []int{categoryID},
+					Filters:     []*OptionFilter{f},
+				}, db)
+				Expect(err).ToNot(HaveOccurred())
+
+				va := findByTitle("ブランド", res.VAs)
+				Expect(va).ToNot(BeNil())
+				Expect(va.Os).ToNot(BeEmpty())
+
+				var titles []string
+				for _, vo := range va.Os {
+					titles = append(titles, vo.Title)
+				}
+				Expect(titles).To(ContainElement("シャネル"))
+			}
+		})
+
+		It("should apply every filter to its own attribute", func() {
+			base, err := FindVisibleAttributes(&SearchConditions{CategoryIDs: []int{categoryID}}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(base.VAs)).To(BeNumerically(">=", 2))
+
+			first, second := base.VAs[0], base.VAs[1]
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Filters: []*OptionFilter{
+					{AttributeID: first.ID, Query: first.Os[0].Title},
+					{AttributeID: second.ID, Query: second.Os[0].Title},
+				},
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+
+			prefixes := map[int]string{first.ID: first.Os[0].Title, second.ID: second.Os[0].Title}
+			for _, va := range res.VAs {
+				if prefix, found := prefixes[va.ID]; found {
+					for _, vo := range va.Os {
+						Expect(vo.Title).To(HavePrefix(prefix))
+					}
+					delete(prefixes, va.ID)
+				}
+			}
+			Expect(prefixes).To(BeEmpty())
+		})
+
+		It("should only count options shown towards pages and offsets", func() {
+			tdb := newTestDB()
+			tdb.attribute(1, "ブランド", false)
+			for i, title := range []string{"エルメス", "シャネル", "シャネル2", "セリーヌ", "シャネル3", "シャネル4"} {
+				tdb.option(11+i, 1, title)
+			}
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+			tdb.Options[tdb.IDs[testUUID(13)]].IsDisabled = true
+
+			sc := &SearchConditions{
+				CategoryIDs: []int{testCategoryID},
+				Filters:     []*OptionFilter{{AttributeUUID: testUUID(1), Prefix: "シャネル"}},
+				PageSize:    2,
+			}
+			page1, err := FindVisibleAttributes(sc, tdb.DB)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(page1.Pages).To(Equal(2))
+			Expect(page1.VAs).To(HaveLen(1))
+			Expect(page1.VAs[0].Os).To(HaveLen(2))
+			Expect(page1.VAs[0].Os[1].Title).To(Equal("シャネル3"))
+			Expect(page1.VAs[0].NextCursor).ToNot(BeEmpty())
+
+			for _, sc := range []*SearchConditions{
+				{CategoryIDs: sc.CategoryIDs, Filters: sc.Filters, PageSize: 2, Offset: 2},
+				{CategoryIDs: sc.CategoryIDs, Filters: sc.Filters, PageSize: 2, Cursors: []string{page1.VAs[0].NextCursor}},
+			} {
+				page2, err := FindVisibleAttributes(sc, tdb.DB)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(page2.Pages).To(Equal(2))
+				Expect(page2.VAs).To(HaveLen(1))
+				Expect(page2.VAs[0].Os).To(HaveLen(1))
+				Expect(page2.VAs[0].Os[0].Title).To(Equal("シャネル4"))
+				Expect(page2.VAs[0].NextCursor).To(BeEmpty())
+			}
+		})
+	})
+
+	When("a category has no rule of its own", func() {
+		It("should inherit the rule of its nearest ancestor", func() {
+			for _, c := range db.CategoryTree {
+				if _, found := db.CategoryRules[c.ID]; found || len(c.Path) == 0 {
+					continue
+				}
+
+				var nearest *CategoryRule
+				for i := len(c.Path) - 1; i >= 0 && nearest == nil; i-- {
+					nearest = db.CategoryRules[c.Path[i]]
+				}
+				if nearest != nil {
+					rule, err := db.CategoryRule(c.ID)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(rule).To(BeIdenticalTo(nearest))
+				}
+			}
+		})
+
+		It("should return the attributes common to all its children when no ancestor has a rule", func() {
+			// E.g. レディース - 小物
+			parentID := db.CategoryTree[categoryID].ParentID
+			_, found := db.CategoryRules[parentID]
+			Expect(found).To(BeFalse())
+
+			rule, err := db.CategoryRule(parentID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rule.CategoryID).To(Equal(parentID))
+			Expect(rule.AttributeIDs).ToNot(BeEmpty())
+
+			for _, id := range rule.AttributeIDs {
+				Expect(db.CategoryRules[categoryID].AttributeIDs).To(ContainElement(id))
+			}
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{parentID},
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.VAs).ToNot(BeEmpty())
+		})
+	})
+
+	When("saving and loading a snapshot", func() {
+		It("should load an identical DB", func() {
+			buf := new(bytes.Buffer)
+			Expect(db.SaveSnapshot(buf)).To(Succeed())
+
+			loaded, err := LoadSnapshot(bytes.NewReader(buf.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(loaded.IDs).To(Equal(db.IDs))
+			Expect(loaded.ReverseIDs).To(Equal(db.ReverseIDs))
+			Expect(loaded.CategoryRules[categoryID]).To(Equal(db.CategoryRules[categoryID]))
+			Expect(loaded.FullCategoryName(categoryID)).To(Equal(db.FullCategoryName(categoryID)))
+
+			for _, sc := range []*SearchConditions{
+				{CategoryIDs: []int{categoryID}, PageSize: 10},
+				{CategoryIDs: []int{categoryID}, Filters: []*OptionFilter{{AttributeID: db.CategoryRules[categoryID].AlwaysVisibleAttributeIDs[0], Query: "a", Fold: true, Match: MatchContains}}},
+			} {
+				want, err := FindVisibleAttributes(sc, db)
+				Expect(err).ToNot(HaveOccurred())
+				got, err := FindVisibleAttributes(sc, loaded)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(got).To(Equal(want))
+			}
+		})
+
+		It("should save the same DB to the same bytes", func() {
+			first, second := new(bytes.Buffer), new(bytes.Buffer)
+			Expect(db.SaveSnapshot(first)).To(Succeed())
+			Expect(db.SaveSnapshot(second)).To(Succeed())
+			Expect(second.Bytes()).To(Equal(first.Bytes()))
+
+			loaded, err := LoadSnapshot(bytes.NewReader(first.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			third := new(bytes.Buffer)
+			Expect(loaded.SaveSnapshot(third)).To(Succeed())
+			Expect(third.Bytes()).To(Equal(first.Bytes()))
+		})
+
+		It("should reject corrupt snapshots", func() {
+			buf := new(bytes.Buffer)
+			Expect(db.SaveSnapshot(buf)).To(Succeed())
+
+			bs := buf.Bytes()
+			bs[len(bs)/2]++
+
+			_, err := LoadSnapshot(bytes.NewReader(bs))
+			Expect(err).To(MatchError(ErrInvalidSnapshot))
+
+			_, err = LoadSnapshot(bytes.NewReader([]byte("nope")))
+			Expect(err).To(MatchError(ErrInvalidSnapshot))
+		})
+	})
+
+	When("reloading the DB", func() {
+		It("should swap in new versions and keep the current one on failure", func() {
+			var fail bool
+			h, err := NewHolder(func() (*DB, error) {
+				if fail {
+					return nil, ErrInvalidSnapshot
+				}
+				return db, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			v1 := h.Current()
+			Expect(v1.DB).To(BeIdenticalTo(db))
+			Expect(v1.Number).To(BeEquivalentTo(1))
+
+			Expect(h.Reload()).To(Succeed())
+			v2 := h.Current()
+			Expect(v2.Number).To(BeEquivalentTo(2))
+			Expect(v2.ETag).ToNot(Equal(v1.ETag))
+
+			fail = true
+			Expect(h.Reload()).To(MatchError(ErrInvalidSnapshot))
+			Expect(h.Current()).To(BeIdenticalTo(v2))
+		})
+	})
+
+	When("multiple categories are selected", func() {
+		// Find a sibling of category 242 that has a rule of its own
+		siblingID := func() int {
+			var id int
+			parentID := db.CategoryTree[categoryID].ParentID
+			for _, c := range db.CategoryTree {
+				if c.ParentID != parentID || c.ID == categoryID {
+					continue
+				}
+				if _, found := db.CategoryRules[c.ID]; found && (id == 0 || c.ID < id) {
+					id = c.ID
+				}
+			}
+			return id
+		}
+
+		It("should return the union of visible attributes by default", func() {
+			otherID := siblingID()
+			Expect(otherID).ToNot(BeZero())
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID, otherID, categoryID},
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.CategoryIDs).To(Equal([]int{categoryID, otherID}))
+
+			seen := make(map[int]bool)
+			for _, va := range res.VAs {
+				Expect(seen[va.ID]).To(BeFalse())
+				seen[va.ID] = true
+			}
+			for _, id := range db.CategoryRules[categoryID].AlwaysVisibleAttributeIDs {
+				Expect(seen[id]).To(BeTrue())
+			}
+			for _, id := range db.CategoryRules[otherID].AlwaysVisibleAttributeIDs {
+				Expect(seen[id]).To(BeTrue())
+			}
+		})
+
+		It("should only return attributes common to all categories when intersecting", func() {
+			otherID := siblingID()
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs:   []int{categoryID, otherID},
+				CategoryMatch: CategoryMatchIntersection,
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, va := range res.VAs {
+				Expect(db.CategoryRules[categoryID].AttributeIDs).To(ContainElement(va.ID))
+				Expect(db.CategoryRules[otherID].AttributeIDs).To(ContainElement(va.ID))
+			}
+		})
+	})
+
+	When("sorting options", func() {
+		// The attribute with the most options, e.g. brand
+		largest := func() *Attribute {
+			var largest *Attribute
+			for _, id := range db.CategoryRules[categoryID].AlwaysVisibleAttributeIDs {
+				if a := db.Attributes[id]; largest == nil || len(a.OptionIDs) > len(largest.OptionIDs) {
+					largest = a
+				}
+			}
+			return largest
+		}
+
+		It("should sort options by display order, then ID", func() {
+			for _, a := range db.Attributes {
+				for i := 1; i < len(a.OptionIDs); i++ {
+					prev, o := db.Options[a.OptionIDs[i-1]], db.Options[a.OptionIDs[i]]
+					Expect(prev.DisplayOrder < o.DisplayOrder || (prev.DisplayOrder == o.DisplayOrder && prev.ID < o.ID)).To(BeTrue())
+				}
+			}
+		})
+
+		It("should sort options alphabetically", func() {
+			a := largest()
+			c := collate.New(language.Japanese)
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Sort:        OptionSortAlphabetical,
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+
+			var found bool
+			for _, va := range res.VAs {
+				if va.ID != a.ID {
+					continue
+				}
+				found = true
+				Expect(va.Os).To(HaveLen(100))
+				for i := 1; i < len(va.Os); i++ {
+					Expect(c.CompareString(va.Os[i-1].Title, va.Os[i].Title)).To(BeNumerically("<=", 0))
+				}
+			}
+			Expect(found).To(BeTrue())
+		})
+
+		It("should sort the most popular options first", func() {
+			a := largest()
+			last := a.OptionIDs[len(a.OptionIDs)-1]
+
+			db.SetOptionPopularity(map[int]int{last: 10})
+			defer db.SetOptionPopularity(nil)
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Sort:        OptionSortPopularity,
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			for _, va := range res.VAs {
+				if va.ID == a.ID {
+					Expect(va.Os[0].ID).To(Equal(last))
+					Expect(va.Os[1].ID).To(Equal(a.OptionIDs[0]))
+				}
+			}
+		})
+
+		It("should reject unknown sort modes", func() {
+			_, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Sort:        "random",
+			}, db)
+			Expect(err).To(MatchError(ErrInvalidSort))
+		})
+	})
+
+	When("several options are selected", func() {
+		It("should only keep the first selection of single-select attributes", func() {
+			rule := db.CategoryRules[categoryID]
+
+			var first, second *Option
+			for selectedOptionID := range rule.ShowIfOptionIDSelected {
+				o, found := db.Options[selectedOptionID]
+				if !found || db.Attributes[o.AttributeID].IsMultipleAllowed || !rule.isAlwaysVisible(o.AttributeID) {
+					continue
+				}
+				for _, id := range db.Attributes[o.AttributeID].OptionIDs {
+					if id != o.ID && !db.Options[id].IsDisabled {
+						first, second = o, db.Options[id]
+						break
+					}
+				}
+				break
+			}
+			if first == nil {
+				Skip("no single-select precondition in category")
+			}
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes: []*AttributeCondition{
+					{AttributeID: first.AttributeID, OptionID: first.ID},
+					{AttributeID: second.AttributeID, OptionID: second.ID},
+				},
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.Attributes).To(Equal([]*AttributeCondition{
+				{AttributeID: first.AttributeID, OptionID: first.ID, AttributeUUID: db.UUID(first.AttributeID), OptionUUID: db.UUID(first.ID)},
+			}))
+
+			only, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{categoryID},
+				Attributes:  res.Corrected.Attributes,
+			}, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.VAs).To(Equal(only.VAs))
+		})
+
+		It("should reveal the options of any selection of the same attribute and those common to all attributes", func() {
+			tdb := newTestDB()
+			tdb.attribute(1, "ブランド", true)
+			tdb.attribute(2, "素材", false)
+			tdb.attribute(3, "型名", false)
+			tdb.option(11, 1, "ブランドA")
+			tdb.option(12, 1, "ブランドB")
+			tdb.option(21, 2, "レザー")
+			for id := 31; id <= 34; id++ {
+				tdb.option(id, 3, fmt.Sprintf("型名%d", id))
+			}
+			tdb.dynamicOption(31, 11)
+			tdb.dynamicOption(32, 11, 21)
+			tdb.dynamicOption(33, 12, 21)
+			tdb.dynamicOption(34, 12)
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+
+			revealed := func(selected ...int) []string {
+				sc := &SearchConditions{CategoryIDs: []int{testCategoryID}}
+				for _, id := range selected {
+					o := tdb.Options[tdb.IDs[testUUID(id)]]
+					sc.Attributes = append(sc.Attributes, &AttributeCondition{AttributeID: o.AttributeID, OptionID: o.ID})
+				}
+				res, err := FindVisibleAttributes(sc, tdb.DB)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.Corrected.Attributes).To(HaveLen(len(selected)))
+
+				var titles []string
+				for _, va := range res.VAs {
+					if va.Title == "型名" {
+						for _, vo := range va.Os {
+							titles = append(titles, vo.Title)
+						}
+					}
+				}
+				return titles
+			}
+
+			Expect(revealed(11)).To(Equal([]string{"型名31", "型名32"}))
+			Expect(revealed(11, 12)).To(Equal([]string{"型名31", "型名32", "型名33", "型名34"}))
+			Expect(revealed(11, 12, 21)).To(Equal([]string{"型名32", "型名33"}))
+			Expect(revealed(11, 21)).To(Equal([]string{"型名32"}))
+		})
+	})
+
+	When("selected options reveal options that are preconditions themselves", func() {
+		// ブランド -> シリーズ -> 型名
+		newCascadeDB := func() *testDB {
+			tdb := newTestDB()
+			tdb.attribute(1, "ブランド", false)
+			tdb.attribute(2, "シリーズ", false)
+			tdb.attribute(3, "型名", false)
+			tdb.option(11, 1, "ブランドA")
+			tdb.option(12, 1, "ブランドB")
+			tdb.option(21, 2, "シリーズA")
+			tdb.option(22, 2, "シリーズB")
+			tdb.option(31, 3, "型名A")
+			tdb.option(32, 3, "型名B")
+			tdb.dynamicOption(21, 11)
+			tdb.dynamicOption(22, 12)
+			tdb.dynamicOption(31, 21)
+			tdb.dynamicOption(32, 22)
+			return tdb
+		}
+
+		find := func(tdb *testDB, selected ...int) *FindVisibleAttributesResponse {
+			sc := &SearchConditions{CategoryIDs: []int{testCategoryID}}
+			for _, id := range selected {
+				o := tdb.Options[tdb.IDs[testUUID(id)]]
+				sc.Attributes = append(sc.Attributes, &AttributeCondition{AttributeID: o.AttributeID, OptionID: o.ID})
+			}
+			res, err := FindVisibleAttributes(sc, tdb.DB)
+			Expect(err).ToNot(HaveOccurred())
+			return res
+		}
+
+		titles := func(tdb *testDB, res *FindVisibleAttributesResponse) (selected, visible []string) {
+			for _, ac := range res.Corrected.Attributes {
+				selected = append(selected, tdb.Options[ac.OptionID].Title)
+			}
+			for _, va := range res.VAs {
+				visible = append(visible, va.Title)
+			}
+			return
+		}
+
+		It("should resolve the whole chain regardless of the order of selections", func() {
+			tdb := newCascadeDB()
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+
+			selected, visible := titles(tdb, find(tdb, 31, 21, 11))
+			Expect(selected).To(Equal([]string{"型名A", "シリーズA", "ブランドA"}))
+			Expect(visible).To(Equal([]string{"ブランド", "シリーズ", "型名"}))
+		})
+
+		It("should remove selections whose chain of preconditions is broken", func() {
+			tdb := newCascadeDB()
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+
+			selected, visible := titles(tdb, find(tdb, 12, 21, 31))
+			Expect(selected).To(Equal([]string{"ブランドB"}))
+			Expect(visible).To(Equal([]string{"ブランド", "シリーズ"}))
+		})
+
+		It("should not let options reveal each other", func() {
+			tdb := newCascadeDB()
+			tdb.attribute(4, "素材", false)
+			tdb.attribute(5, "素材/詳細", false)
+			tdb.option(41, 4, "レザー")
+			tdb.option(51, 5, "クロコダイル")
+			tdb.dynamicOption(41, 51)
+			tdb.dynamicOption(51, 41)
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+
+			selected, _ := titles(tdb, find(tdb, 11, 41, 51))
+			Expect(selected).To(Equal([]string{"ブランドA"}))
+		})
+
+		It("should stop when selections keep hiding each other", func() {
+			// 型名A reveals シリーズB, which hides 型名A again since
+			// ブランドA and シリーズB reveal no 型名 in common
+			tdb := newTestDB()
+			tdb.attribute(1, "ブランド", false)
+			tdb.attribute(2, "シリーズ", false)
+			tdb.attribute(3, "型名", false)
+			tdb.option(11, 1, "ブランドA")
+			tdb.option(22, 2, "シリーズB")
+			tdb.option(31, 3, "型名A")
+			tdb.option(32, 3, "型名B")
+			tdb.dynamicOption(31, 11)
+			tdb.dynamicOption(22, 31)
+			tdb.dynamicOption(32, 22)
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+
+			selected, _ := titles(tdb, find(tdb, 11, 31, 22))
+			Expect(selected).To(Equal([]string{"ブランドA"}))
+		})
+
+		It("should explain why attributes and options are visible and selections were removed", func() {
+			tdb := newCascadeDB()
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+
+			id := func(n int) int { return tdb.IDs[testUUID(n)] }
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				CategoryIDs: []int{testCategoryID},
+				Attributes: []*AttributeCondition{
+					{AttributeID: id(1), OptionID: id(11)},
+					{AttributeID: id(2), OptionID: id(21)},
+					{AttributeID: id(2), OptionID: id(22)},
+					{AttributeID: id(3), OptionID: id(32)},
+					{AttributeID: id(1), OptionID: id(11)},
+					{AttributeID: 99_999, OptionID: id(11)},
+				},
+				Explain: true,
+			}, tdb.DB)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res.VAs).To(HaveLen(3))
+			Expect(res.VAs[0].Explanation.Reason).To(Equal(ReasonAlwaysVisible))
+			Expect(res.VAs[0].Explanation.Message).To(Equal("ブランド is always visible in テスト"))
+			Expect(res.VAs[0].Os[0].Explanation).To(Equal(res.VAs[0].Explanation))
+			Expect(res.VAs[1].Explanation.Reason).To(Equal(ReasonRevealed))
+			Expect(res.VAs[1].Explanation.RevealedBy).To(Equal([]*AttributeCondition{{AttributeID: id(1), OptionID: id(11), AttributeUUID: testUUID(1), OptionUUID: testUUID(11)}}))
+			Expect(res.VAs[2].Os[0].Explanation.Message).To(Equal("型名 - 型名A is revealed by シリーズ - シリーズA"))
+
+			var reasons []RemovalReason
+			for _, rc := range res.Removed {
+				reasons = append(reasons, rc.Reason)
+				Expect(rc.Explanation.Message).ToNot(BeEmpty())
+			}
+			Expect(reasons).To(Equal([]RemovalReason{
+				RemovedSingleSelectConflict,
+				RemovedDuplicate,
+				RemovedUnknownAttribute,
+				RemovedOptionNotVisible,
+			}))
+			Expect(res.Removed[3].Explanation.Message).To(Equal("型名 - 型名B is only visible when one of シリーズ - シリーズB is selected"))
+		})
+
+		It("should explain why selections were removed when no category is selected", func() {
+			tdb := newCascadeDB()
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+
+			id := func(n int) int { return tdb.IDs[testUUID(n)] }
+
+			res, err := FindVisibleAttributes(&SearchConditions{
+				Attributes: []*AttributeCondition{
+					{AttributeID: id(1), OptionID: id(11)},
+					{AttributeID: id(1), OptionID: id(11)},
+					{AttributeID: 99_999, OptionID: id(11)},
+				},
+				PageSize: 10,
+				Explain:  true,
+			}, tdb.DB)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.VAs).To(BeEmpty())
+			Expect(res.Corrected.PageSize).To(Equal(10))
+			Expect(res.Corrected.Explain).To(BeTrue())
+
+			var reasons []RemovalReason
+			for _, rc := range res.Removed {
+				reasons = append(reasons, rc.Reason)
+				Expect(rc.Explanation).ToNot(BeNil())
+				Expect(rc.Explanation.Message).ToNot(BeEmpty())
+			}
+			Expect(reasons).To(Equal([]RemovalReason{
+				RemovedDuplicate,
+				RemovedUnknownAttribute,
+				RemovedAttributeNotInCategory,
+			}))
+		})
+	})
+
+	When("validating listings and building sell forms", func() {
+		newListingDB := func() *testDB {
+			tdb := newTestDB()
+			tdb.attribute(1, "ブランド", false)
+			tdb.attribute(2, "カラー", true)
+			tdb.attribute(3, "型名", false)
+			tdb.required(1)
+			tdb.required(3)
+			tdb.option(11, 1, "ブランドA")
+			tdb.option(12, 1, "ブランドB")
+			tdb.option(21, 2, "ブルー")
+			tdb.option(22, 2, "グレー")
+			tdb.option(31, 3, "型名A")
+			tdb.option(32, 3, "型名B")
+			tdb.dynamicOption(31, 11)
+			tdb.dynamicOption(32, 12)
+			Expect(tdb.PostProcessImportedData()).To(Succeed())
+			return tdb
+		}
+
+		validate := func(tdb *testDB, selected ...int) (errs []string) {
+			var acs []*AttributeCondition
+			for _, id := range selected {
+				o := tdb.Options[tdb.IDs[testUUID(id)]]
+				acs = append(acs, &AttributeCondition{AttributeID: o.AttributeID, OptionID: o.ID})
+			}
+			res, err := tdb.ValidateListing(testCategoryID, acs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Valid).To(Equal(len(res.Errors) == 0))
+			for _, fe := range res.Errors {
+				errs = append(errs, fe.AttributeTitle+" "+string(fe.Error))
+			}
+			return
+		}
+
+		It("should accept complete listings", func() {
+			tdb := newListingDB()
+			Expect(validate(tdb, 11, 31)).To(BeEmpty())
+			Expect(validate(tdb, 11, 21, 22, 31)).To(BeEmpty())
+		})
+
+		It("should require required attributes that are visible", func() {
+			tdb := newListingDB()
+			Expect(validate(tdb)).To(Equal([]string{"ブランド required"}))
+			Expect(validate(tdb, 21)).To(Equal([]string{"ブランド required"}))
+			Expect(validate(tdb, 12)).To(Equal([]string{"型名 required"}))
+		})
+
+		It("should reject options that are not visible or conflict", func() {
+			tdb := newListingDB()
+			Expect(validate(tdb, 11, 32)).To(Equal([]string{"型名 not_visible", "型名 required"}))
+			Expect(validate(tdb, 11, 12, 31)).To(Equal([]string{"ブランド single_select"}))
+		})
+
+		It("should return an error for unknown categories", func() {
+			_, err := newListingDB().ValidateListing(-1, nil)
+			Expect(err).To(MatchError(ErrUnknownCategory))
+		})
+
+		It("should lay out the visible fields of the sell form by page", func() {
+			tdb := newListingDB()
+			tdb.Attributes[tdb.IDs[testUUID(2)]].DisplayPage = 2
+
+			id := func(n int) int { return tdb.IDs[testUUID(n)] }
+
+			layout, err := tdb.FormLayout(testCategoryID, []*AttributeCondition{
+				{AttributeID: id(1), OptionID: id(11)},
+				{AttributeID: id(3), OptionID: id(32)},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(layout.Pages).To(HaveLen(2))
+
+			page1 := layout.Pages[0]
+			Expect(page1.Page).To(Equal(1))
+			Expect(page1.Fields).To(HaveLen(2))
+			Expect(page1.Fields[0].Title).To(Equal("ブランド"))
+			Expect(page1.Fields[0].Required).To(BeTrue())
+			Expect(page1.Fields[0].Widget).To(Equal("single_select"))
+			Expect(page1.Fields[0].Options).To(HaveLen(2))
+			Expect(page1.Fields[0].Selected).To(Equal([]int{id(11)}))
+			Expect(page1.Fields[1].Title).To(Equal("型名"))
+			Expect(page1.Fields[1].Options).To(Equal([]*VisibleOption{{ID: id(31), UUID: testUUID(31), Title: "型名A"}}))
+			Expect(page1.Fields[1].Selected).To(BeEmpty())
+
+			page2 := layout.Pages[1]
+			Expect(page2.Page).To(Equal(2))
+			Expect(page2.Fields).To(HaveLen(1))
+			Expect(page2.Fields[0].Title).To(Equal("カラー"))
+			Expect(page2.Fields[0].Multiple).To(BeTrue())
+		})
+	})
+
+	When("returning option details", func() {
+		It("should parse option colors", func() {
+			rgb, err := ParseColor(`{"red":255,"green":128,"blue":0}`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rgb).To(Equal(&RGB{Red: 255, Green: 128, Blue: 0, Hex: "#ff8000"}))
+
+			rgb, err = ParseColor("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rgb).To(BeNil())
+
+			for _, c := range []string{`{"red":256,"green":0,"blue":0}`, `{"red":0}`, `red`} {
+				_, err = ParseColor(c)
+				Expect(err).To(MatchError(ErrInvalidColor))
+			}
+		})
+
+		It("should return colors and subtitles when asked to", func() {
+			sc := &SearchConditions{CategoryIDs: []int{categoryID}, PageSize: 1_000}
+
+			res, err := FindVisibleAttributes(sc, db)
+			Expect(err).ToNot(HaveOccurred())
+			for _, va := range res.VAs {
+				for _, vo := range va.Os {
+					Expect(vo.Color).To(BeNil())
+					Expect(vo.Subtitle).To(BeEmpty())
+				}
+			}
+
+			sc.OptionDetails = true
+			res, err = FindVisibleAttributes(sc, db)
+			Expect(err).ToNot(HaveOccurred())
+
+			var colors int
+			for _, va := range res.VAs {
+				for _, vo := range va.Os {
+					o := db.Options[vo.ID]
+					Expect(vo.Subtitle).To(Equal(o.Subtitle))
+					if o.Color != "" {
+						Expect(vo.Color).ToNot(BeNil())
+						colors++
+					}
+				}
+			}
+			Expect(colors).ToNot(BeZero())
+		})
+	})
+
+	When("counting items per option", func() {
+		It("should return counts and hide empty options when asked to", func() {
+			sc := &SearchConditions{CategoryIDs: []int{categoryID}, PageSize: 1_000, Counts: true}
+
+			_, err := FindVisibleAttributes(sc, db)
+			Expect(err).To(MatchError(ErrNoOptionCounter))
+
+			res, err := FindVisibleAttributesWithCounts(sc, db, nil)
+			Expect(err).To(MatchError(ErrNoOptionCounter))
+
+			// Count the first option of each visible attribute
+			counts := make(OptionCounts)
+			var total int
+			res, err = FindVisibleAttributesWithCounts(&SearchConditions{CategoryIDs: []int{categoryID}, PageSize: 1_000}, db, counts)
+			Expect(err).ToNot(HaveOccurred())
+			for _, va := range res.VAs {
+				counts[va.Os[0].ID] = 7
+				total += len(va.Os)
+				for _, vo := range va.Os {
+					Expect(vo.Count).To(BeNil())
+				}
+			}
+			Expect(total).To(BeNumerically(">", len(counts)))
+
+			res, err = FindVisibleAttributesWithCounts(sc, db, counts)
+			Expect(err).ToNot(HaveOccurred())
+			var counted int
+			for _, va := range res.VAs {
+				for _, vo := range va.Os {
+					Expect(vo.Count).ToNot(BeNil())
+					Expect(*vo.Count).To(Equal(counts[vo.ID]))
+					counted++
+				}
+			}
+			Expect(counted).To(Equal(total))
+
+			sc.HideEmpty = true
+			res, err = FindVisibleAttributesWithCounts(sc, db, counts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Corrected.HideEmpty).To(BeTrue())
+			Expect(res.VAs).To(HaveLen(len(counts)))
+			for _, va := range res.VAs {
+				Expect(va.Os).To(HaveLen(1))
+				Expect(*va.Os[0].Count).To(Equal(7))
+			}
+		})
+
+		It("should count options by popularity once loaded", func() {
+			sc := &SearchConditions{CategoryIDs: []int{categoryID}, PageSize: 1_000, HideEmpty: true}
+
+			// Without popularity every option would be hidden
+			_, err := FindVisibleAttributesWithCounts(sc, db, &PopularityCounter{})
+			Expect(err).To(MatchError(ErrNoOptionCounter))
+
+			res, err := FindVisibleAttributes(&SearchConditions{CategoryIDs: []int{categoryID}}, db)
+			Expect(err).ToNot(HaveOccurred())
+			used := res.VAs[0].Os[0].ID
+			db.SetOptionPopularity(map[int]int{used: 3})
+			defer db.SetOptionPopularity(nil)
+
+			res, err = FindVisibleAttributesWithCounts(sc, db, &PopularityCounter{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.VAs).To(HaveLen(1))
+			Expect(res.VAs[0].Os).To(HaveLen(1))
+			Expect(res.VAs[0].Os[0].ID).To(Equal(used))
+			Expect(*res.VAs[0].Os[0].Count).To(Equal(3))
+		})
+	})
+
+	When("importing from other sources", func() {
+		It("should detect formats of files in a file system", func() {
+			var gz bytes.Buffer
+			zw := gzip.NewWriter(&gz)
+			zw.Write([]byte("category_attribute_id,category_id,attribute_id,is_disabled,created_at,updated_at\n" +
+				testUUID(1001) + ",1," + testUUID(1) + ",f,,\n"))
+			zw.Close()
+
+			fsys := fstest.MapFS{
+				"export/attribute.ndjson": {Data: []byte(
+					`{"attribute_id":"` + testUUID(1) + `","attribute_type":"enum","is_multiple_allowed":false,"is_required":true,"is_disabled":false,"title":"ブランド","display_order":1,"created_at":null,"updated_at":null,"searchable":true,"listing_type":"single_select","display_page":1}` + "\n",
+				)},
+				"export/attribute_option.csv": {Data: []byte("\uFEFFattribute_option_id,attribute_id,title,is_disabled,display_order,created_at,updated_at,color,subtitle\n" +
+					testUUID(11) + "," + testUUID(1) + ",シャネル,f,1,,,,\n" +
+					testUUID(12) + "," + testUUID(1) + ",\"エルメス, パリ\",f,2,,,,\n")},
+				"export/category_attribute.csv.gz":    {Data: gz.Bytes()},
+				"export/dynamic_attribute_option.csv": {Data: []byte("dynamic_attribute_option_id,category_id,attribute_option_id,precondition,is_disabled,created_at,updated_at\n")},
+				"export/attribute.txt":                {Data: []byte("not a table")},
+			}
+
+			tdb := NewDB()
+			tdb.CategoryTree[testCategoryID] = &Category{ID: testCategoryID, Name: "テスト"}
+			err := tdb.ImportPostgresDatabase(ImportPostgresDatabaseArgs{Source: &importer.FSSource{FS: fsys, Dir: "export"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			a := tdb.Attributes[tdb.IDs[testUUID(1)]]
+			Expect(a.Title).To(Equal("ブランド"))
+			Expect(a.IsRequired).To(BeTrue())
+			Expect(a.IsSearchable).To(BeTrue())
+			Expect(a.IsMultipleAllowed).To(BeFalse())
+			Expect(a.DisplayPage).To(Equal(1))
+			Expect(a.OptionIDs).To(HaveLen(2))
+			Expect(tdb.Options[a.OptionIDs[1]].Title).To(Equal("エルメス, パリ"))
+			Expect(tdb.CategoryRules[testCategoryID].AttributeIDs).To(Equal([]int{a.ID}))
+		})
+
+		It("should map columns by header name", func() {
+			tdb := NewDB()
+
+			// Reordered columns, different case and an unknown column
+			headers := []string{"Title", "attribute_id", "display_page", "listing_type", "searchable", "display_order", "is_disabled", "is_required", "is_multiple_allowed", "attribute_type", "extra"}
+			Expect(tdb.AddAttribute([]string{"ブランド", testUUID(1), "2", "single_select", "t", "5", "f", "t", "f", "enum", "?"}, headers)).To(Succeed())
+
+			a := tdb.Attributes[tdb.IDs[testUUID(1)]]
+			Expect(a.Title).To(Equal("ブランド"))
+			Expect(a.DisplayPage).To(Equal(2))
+			Expect(a.DisplayOrder).To(Equal(5))
+			Expect(a.IsRequired).To(BeTrue())
+			Expect(a.IsMultipleAllowed).To(BeFalse())
+
+			// Optional columns can be left out
+			headers = []string{"attribute_option_id", "attribute_id", "title", "is_disabled", "display_order"}
+			Expect(tdb.AddOption([]string{testUUID(11), testUUID(1), "シャネル", "f", "1"}, headers)).To(Succeed())
+			Expect(tdb.Options[tdb.IDs[testUUID(11)]].Title).To(Equal("シャネル"))
+
+			// Required columns can't
+			err := tdb.AddOption([]string{testUUID(12), "シャネル"}, []string{"attribute_option_id", "title"})
+			Expect(err).To(MatchError(importer.ErrSchemaDrift))
+			Expect(err.Error()).To(ContainSubstring("missing required columns attribute_id, is_disabled, display_order"))
+		})
+
+		It("should skip bad records as set by the error policy", func() {
+			src := &importer.FSSource{FS: fstest.MapFS{
+				"attribute.csv": {Data: []byte("attribute_id,attribute_type,is_multiple_allowed,is_required,is_disabled,title,display_order,created_at,updated_at,searchable,listing_type,display_page\n" +
+					testUUID(1) + ",enum,f,f,f,ブランド,1,,,t,single_select,1\n" +
+					testUUID(2) + ",enum,f,f,f,色,not-a-number,,,t,single_select,1\n" +
+					testUUID(3) + ",enum,f,f\n" +
+					testUUID(4) + ",enum,f,f,f,サイズ,4,,,t,single_select,1\n")},
+			}}
+
+			err := NewDB().ImportPostgresDatabase(ImportPostgresDatabaseArgs{Source: src})
+			Expect(err).To(MatchError(ContainSubstring("attribute.csv record 3")))
+
+			tdb := NewDB()
+			err = tdb.ImportPostgresDatabase(ImportPostgresDatabaseArgs{Source: src, Errors: importer.ErrorHandling{Policy: importer.SkipAndCollect}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tdb.Attributes).To(HaveLen(2))
+		})
+
+		It("should import the same data from a tar archive", func() {
+			file := filepath.Join(GinkgoT().TempDir(), "export.tar.gz")
+			f, err := os.Create(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			zw := gzip.NewWriter(f)
+			tw := tar.NewWriter(zw)
+			for _, name := range []string{"attribute.csv.gz", "attribute_option.csv.gz", "category_attribute.csv.gz", "dynamic_attribute_option.csv.gz"} {
+				b, err := os.ReadFile(filepath.Join("../../../test-data", name))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(b))})).To(Succeed())
+				_, err = tw.Write(b)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(tw.Close()).To(Succeed())
+			Expect(zw.Close()).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			tdb := NewDB()
+			err = tdb.LoadCategoriesJSON("../../../test-data/categories.json")
+			Expect(err).ToNot(HaveOccurred())
+			err = tdb.ImportPostgresDatabase(ImportPostgresDatabaseArgs{Source: &importer.TarSource{File: file}})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(tdb.Attributes).To(HaveLen(len(db.Attributes)))
+			Expect(tdb.Options).To(HaveLen(len(db.Options)))
+			Expect(tdb.CategoryRules).To(HaveLen(len(db.CategoryRules)))
+
+			_, err = (&importer.TarSource{File: file}).Open("missing.csv")
+			Expect(err).To(MatchError(importer.ErrFileNotFound))
+		})
 	})
 })
+
+const testCategoryID = 1
+
+func testUUID(id int) string {
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", id)
+}
+
+// A small DB built from CSV records, for cases the test data doesn't cover.
+// All attributes belong to a single category.
+type testDB struct {
+	*DB
+}
+
+func newTestDB() *testDB {
+	db := NewDB()
+	db.CategoryTree[testCategoryID] = &Category{ID: testCategoryID, Name: "テスト"}
+	return &testDB{db}
+}
+
+func (db *testDB) attribute(id int, title string, multi bool) {
+	isMulti := "f"
+	if multi {
+		isMulti = "t"
+	}
+	Expect(db.AddAttribute([]string{
+		testUUID(id), "enum", isMulti, "f", "f", title, strconv.Itoa(id), "", "", "t", "single_select", "1",
+	}, nil)).To(Succeed())
+	Expect(db.AddCategoryAttribute([]string{
+		testUUID(id + 1_000), strconv.Itoa(testCategoryID), testUUID(id), "f", "", "",
+	}, nil)).To(Succeed())
+}
+
+func (db *testDB) option(id, attributeID int, title string) {
+	Expect(db.AddOption([]string{
+		testUUID(id), testUUID(attributeID), title, "f", strconv.Itoa(id), "", "", "", "",
+	}, nil)).To(Succeed())
+}
+
+func (db *testDB) required(id int) {
+	db.Attributes[db.IDs[testUUID(id)]].IsRequired = true
+}
+
+// Makes the option visible only when any of the preconditions is selected.
+func (db *testDB) dynamicOption(id int, preconditions ...int) {
+	var uuids []string
+	for _, pc := range preconditions {
+		uuids = append(uuids, testUUID(pc))
+	}
+	Expect(db.AddDynamicOption([]string{
+		testUUID(id + 2_000), strconv.Itoa(testCategoryID), testUUID(id), "{" + strings.Join(uuids, ",") + "}", "f", "", "",
+	}, nil)).To(Succeed())
+}
@@ -0,0 +1,61 @@
+package attribute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidColor = errors.New("invalid color")
+
+// RGB is the color of an option, e.g. to render swatches for カラー options.
+type RGB struct {
+	Red   int    `json:"red"`
+	Green int    `json:"green"`
+	Blue  int    `json:"blue"`
+	Hex   string `json:"hex"` // e.g. #ff0000
+}
+
+// ParseColor parses colors as stored in the Item Attributes database,
+// e.g. {"red":255,"green":0,"blue":0}. Returns nil for empty colors.
+func ParseColor(s string) (*RGB, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var c struct {
+		Red   *int `json:"red"`
+		Green *int `json:"green"`
+		Blue  *int `json:"blue"`
+	}
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		return nil, fmt.Errorf("%w: '%s': %s", ErrInvalidColor, s, err)
+	}
+	if c.Red == nil || c.Green == nil || c.Blue == nil {
+		return nil, fmt.Errorf("%w: '%s': missing red, green or blue", ErrInvalidColor, s)
+	}
+
+	rgb := &RGB{Red: *c.Red, Green: *c.Green, Blue: *c.Blue}
+	for _, v := range []int{rgb.Red, rgb.Green, rgb.Blue} {
+		if v < 0 || v > 255 {
+			return nil, fmt.Errorf("%w: '%s': %d out of range", ErrInvalidColor, s, v)
+		}
+	}
+	rgb.Hex = fmt.Sprintf("#%02x%02x%02x", rgb.Red, rgb.Green, rgb.Blue)
+
+	return rgb, nil
+}
+
+// Colors are parsed once after import, see PostProcessImportedData.
+// Invalid colors are ignored.
+func (o *Option) parseColor() {
+	rgb, err := ParseColor(o.Color)
+	if err != nil {
+		if DebugPrint {
+			fmt.Printf("WARN: option %d: %s\n", o.ID, err)
+		}
+		rgb = nil
+	}
+	o.RGB = rgb
+}
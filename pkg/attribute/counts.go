@@ -0,0 +1,49 @@
+package attribute
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNoOptionCounter = errors.New("option counts not available")
+
+// OptionCounter counts the items using each option, e.g. to show
+// "シャネル (1,234)" in the filter panel.
+type OptionCounter interface {
+	CountOptions(a *CountOptionsArgs) (map[int]int, error) // key = option ID
+}
+
+type CountOptionsArgs struct {
+	DB           *DB                   // the version of the DB serving the request
+	CategoryIDs  []int                 // count items in these categories
+	AttributeIDs []int                 // count options of these attributes
+	Selected     []*AttributeCondition // count items matching the selected options
+}
+
+// OptionCounts is an OptionCounter backed by precomputed counts, e.g. from
+// a local index. Ignores the selected categories and options.
+type OptionCounts map[int]int // key = option ID
+
+func (c OptionCounts) CountOptions(a *CountOptionsArgs) (map[int]int, error) {
+	return c, nil
+}
+
+// PopularityCounter counts options by their popularity, i.e. the number of
+// items using each option in all categories, see SetOptionPopularity. Counts
+// ignore the selected categories and options, so they're upper bounds: hiding
+// empty options only hides options no item uses at all.
+type PopularityCounter struct{}
+
+func (c *PopularityCounter) CountOptions(a *CountOptionsArgs) (map[int]int, error) {
+	counts := make(map[int]int)
+	for _, o := range a.DB.Options {
+		if o.Popularity > 0 {
+			counts[o.ID] = o.Popularity
+		}
+	}
+	if len(counts) == 0 && len(a.DB.Options) > 0 {
+		// Every option would be empty
+		return nil, fmt.Errorf("%w: option popularity not loaded", ErrNoOptionCounter)
+	}
+	return counts, nil
+}
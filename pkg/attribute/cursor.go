@@ -0,0 +1,70 @@
+package attribute
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// EncodeCursor returns an opaque cursor pointing to the option at the given
+// offset in the list of options shown for an attribute. Since the offset
+// depends on the options in the DB, a cursor is only valid for the same
+// version of the DB and search conditions: after a reload that adds or
+// reorders options the next page can skip or repeat options.
+func EncodeCursor(attributeUUID string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(attributeUUID + ":" + strconv.Itoa(offset)))
+}
+
+// DecodeCursor returns the attribute UUID and option offset stored in the
+// cursor.
+func DecodeCursor(cursor string) (attributeUUID string, offset int, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %s", ErrInvalidCursor, cursor)
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, fmt.Errorf("%w: %s", ErrInvalidCursor, cursor)
+	}
+
+	attributeUUID = parts[0]
+	offset, err = strconv.Atoi(parts[1])
+	if err != nil || offset < 0 {
+		return "", 0, fmt.Errorf("%w: %s", ErrInvalidCursor, cursor)
+	}
+
+	return
+}
+
+// Returns a cursor for the attribute, using its int ID if it has no UUID.
+func (db *DB) encodeCursor(attributeID, offset int) string {
+	uuid, found := db.ReverseIDs[attributeID]
+	if !found {
+		uuid = strconv.Itoa(attributeID)
+	}
+	return EncodeCursor(uuid, offset)
+}
+
+// Returns the attribute ID and option offset stored in the cursor, see
+// encodeCursor, or ErrInvalidCursor if the attribute doesn't exist.
+func (db *DB) decodeCursor(cursor string) (attributeID, offset int, err error) {
+	uuid, offset, err := DecodeCursor(cursor)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	attributeID, found := db.IDs[uuid]
+	if !found {
+		attributeID, _ = strconv.Atoi(uuid)
+	}
+	if _, found := db.Attributes[attributeID]; !found {
+		return 0, 0, fmt.Errorf("%w: unknown attribute %s", ErrInvalidCursor, uuid)
+	}
+
+	return
+}
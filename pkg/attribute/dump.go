@@ -10,7 +10,7 @@ type DumpOpts struct {
 	MaxLinesToPrint int
 }
 
-func (db *DB) Dump(o DumpOpts) {
+func (db *DB) Dump(o DumpOpts) error {
 	if o.MaxLinesToPrint == 0 {
 		// Print max 5 attributes, options and dynamic options per node
 		// in the tree by default
@@ -20,8 +20,13 @@ func (db *DB) Dump(o DumpOpts) {
 	// Print all category rules
 	{
 		if o.OnlyCategoryID > 0 {
-			cr := db.CategoryRules[o.OnlyCategoryID]
-			db.DumpCategoryRule(cr, o.MaxLinesToPrint)
+			cr, err := db.CategoryRule(o.OnlyCategoryID)
+			if err != nil {
+				return err
+			}
+			if err = db.DumpCategoryRule(cr, o.MaxLinesToPrint); err != nil {
+				return err
+			}
 		} else {
 			var categoryIDs []int
 			for id := range db.CategoryRules {
@@ -33,7 +38,9 @@ func (db *DB) Dump(o DumpOpts) {
 
 			for _, id := range categoryIDs {
 				cr := db.CategoryRules[id]
-				db.DumpCategoryRule(cr, o.MaxLinesToPrint)
+				if err := db.DumpCategoryRule(cr, o.MaxLinesToPrint); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -63,9 +70,11 @@ func (db *DB) Dump(o DumpOpts) {
 		}
 	}
 	fmt.Printf("Refs              : %d\n\n", refs)
+
+	return nil
 }
 
-func (db *DB) DumpCategoryRule(cr *CategoryRule, max int) {
+func (db *DB) DumpCategoryRule(cr *CategoryRule, max int) error {
 	fmt.Printf(
 		"category [%6d] - %s (%d / %d attributes, %d conditions)\n",
 		cr.CategoryID, db.FullCategoryName(cr.CategoryID),
@@ -73,11 +82,17 @@ func (db *DB) DumpCategoryRule(cr *CategoryRule, max int) {
 	)
 
 	for _, attributeID := range cr.AlwaysVisibleAttributeIDs {
-		a := db.Attribute(attributeID)
+		a, err := db.Attribute(attributeID)
+		if err != nil {
+			return err
+		}
 
 		fmt.Printf(" - attribute [%6d] - %s (%d)\n", a.ID, a.Title, a.DisplayOrder)
 		for i, optionID := range a.OptionIDs {
-			o := db.Option(optionID)
+			o, err := db.Option(optionID)
+			if err != nil {
+				return err
+			}
 
 			fmt.Printf("    - option [%6d] - %s (%d)\n", o.ID, o.Title, o.DisplayOrder)
 			if i >= 50 {
@@ -88,18 +103,32 @@ func (db *DB) DumpCategoryRule(cr *CategoryRule, max int) {
 	}
 
 	for selectedOptionID, limitedOptions := range cr.ShowIfOptionIDSelected {
-		so := db.Option(selectedOptionID)
-		soa := db.Attribute(so.AttributeID)
+		so, err := db.Option(selectedOptionID)
+		if err != nil {
+			return err
+		}
+		soa, err := db.Attribute(so.AttributeID)
+		if err != nil {
+			return err
+		}
 
 		fmt.Printf(" - precondition: attribute [%6d] - %s - option [%6d] - %s\n", soa.ID, soa.Title, so.ID, so.Title)
 
 		for _, lo := range limitedOptions {
-			a := db.Attribute(lo.AttributeID)
+			a, err := db.Attribute(lo.AttributeID)
+			if err != nil {
+				return err
+			}
 			fmt.Printf("    - attribute [%6d] - %s (%d)\n", a.ID, a.Title, a.DisplayOrder)
 			for _, optionID := range lo.OptionIDs {
-				o := db.Option(optionID)
+				o, err := db.Option(optionID)
+				if err != nil {
+					return err
+				}
 				fmt.Printf("       - option [%6d] - %s (%d)\n", o.ID, o.Title, o.DisplayOrder)
 			}
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,238 @@
+package attribute
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Reasons for attributes and options to be visible, see Explanation.
+const (
+	ReasonAlwaysVisible = "always_visible"
+	ReasonRevealed      = "revealed"
+)
+
+// RemovalReason tells why a selected option was removed from the search
+// conditions, see FindVisibleAttributesResponse.Removed.
+type RemovalReason string
+
+const (
+	// The same option was selected more than once
+	RemovedDuplicate RemovalReason = "duplicate"
+	// Another option of a single-select attribute was selected first
+	RemovedSingleSelectConflict RemovalReason = "single_select_conflict"
+	// The attribute doesn't exist
+	RemovedUnknownAttribute RemovalReason = "unknown_attribute"
+	// The attribute isn't used by the selected categories
+	RemovedAttributeNotInCategory RemovalReason = "attribute_not_in_category"
+	// The attribute or option is disabled
+	RemovedDisabled RemovalReason = "disabled"
+	// The option doesn't exist, belongs to another attribute or is only
+	// visible when other options are selected
+	RemovedOptionNotVisible RemovalReason = "option_not_visible"
+)
+
+// Explanation tells why an attribute or option is visible, or why a selected
+// option was removed, see SearchConditions.Explain.
+type Explanation struct {
+	Reason     string                `json:"reason"`
+	RevealedBy []*AttributeCondition `json:"revealed_by,omitempty"` // selected options revealing the attribute or option
+	Message    string                `json:"message"`
+}
+
+type RemovedCondition struct {
+	AttributeID    int           `json:"attribute_id"`
+	OptionID       int           `json:"option_id"`
+	AttributeUUID  string        `json:"attribute_uuid,omitempty"`
+	OptionUUID     string        `json:"option_uuid,omitempty"`
+	AttributeTitle string        `json:"attribute_title,omitempty"` // e.g. to tell the user the ブランド filter was cleared
+	OptionTitle    string        `json:"option_title,omitempty"`
+	Reason         RemovalReason `json:"reason"`
+	Explanation    *Explanation  `json:"explanation,omitempty"` // explain mode only
+}
+
+func (db *DB) newRemovedCondition(ac *AttributeCondition, reason RemovalReason) *RemovedCondition {
+	rc := &RemovedCondition{
+		AttributeID:   ac.AttributeID,
+		OptionID:      ac.OptionID,
+		AttributeUUID: ac.AttributeUUID,
+		OptionUUID:    ac.OptionUUID,
+		Reason:        reason,
+	}
+	if a, found := db.Attributes[ac.AttributeID]; found {
+		rc.AttributeTitle = a.Title
+	}
+	if o, found := db.Options[ac.OptionID]; found && o.AttributeID == ac.AttributeID {
+		rc.OptionTitle = o.Title
+	}
+	return rc
+}
+
+// Annotates visible attributes and options with why they're visible.
+func (db *DB) explainVisible(res *FindVisibleAttributesResponse, rule *CategoryRule, catIDs []int, active map[int][]int) {
+	var categories []string
+	for _, id := range catIDs {
+		categories = append(categories, db.FullCategoryName(id))
+	}
+
+	selected := db.sortedConditions(active)
+
+	for _, va := range res.VAs {
+		if rule.isAlwaysVisible(va.ID) {
+			e := &Explanation{
+				Reason:  ReasonAlwaysVisible,
+				Message: fmt.Sprintf("%s is always visible in %s", va.Title, strings.Join(categories, ", ")),
+			}
+			va.Explanation = e
+			for _, vo := range va.Os {
+				vo.Explanation = e
+			}
+			continue
+		}
+
+		va.Explanation = db.explainRevealed(rule, selected, va.Title, func(lo *LimitedOptions) bool {
+			return lo.AttributeID == va.ID
+		})
+		for _, vo := range va.Os {
+			vo.Explanation = db.explainRevealed(rule, selected, va.Title+" - "+vo.Title, func(lo *LimitedOptions) bool {
+				return lo.AttributeID == va.ID && containsInt(lo.OptionIDs, vo.ID)
+			})
+		}
+	}
+}
+
+// Explains which of the selected options reveal something, as decided by
+// reveals.
+func (db *DB) explainRevealed(rule *CategoryRule, selected []*AttributeCondition, title string, reveals func(lo *LimitedOptions) bool) *Explanation {
+	e := &Explanation{Reason: ReasonRevealed}
+
+	var by []string
+	for _, ac := range selected {
+		for _, lo := range rule.ShowIfOptionIDSelected[ac.OptionID] {
+			if reveals(lo) {
+				e.RevealedBy = append(e.RevealedBy, ac)
+				by = append(by, db.conditionTitle(ac.AttributeID, ac.OptionID))
+				break
+			}
+		}
+	}
+
+	e.Message = fmt.Sprintf("%s is revealed by %s", title, strings.Join(by, ", "))
+
+	return e
+}
+
+// Returns the selected options as conditions, sorted like the visible
+// attributes.
+func (db *DB) sortedConditions(selected map[int][]int) (res []*AttributeCondition) {
+	var attributeIDs []int
+	for id := range selected {
+		attributeIDs = append(attributeIDs, id)
+	}
+	db.sortAttributeIDs(attributeIDs)
+
+	for _, attributeID := range attributeIDs {
+		optionIDs := append([]int{}, selected[attributeID]...)
+		db.sortOptionIDs(optionIDs)
+		for _, optionID := range optionIDs {
+			res = append(res, db.newCondition(attributeID, optionID))
+		}
+	}
+	return
+}
+
+// Decides why a selected option was not in effect after resolving selections,
+// see resolveSelections.
+func (db *DB) removalReason(rule *CategoryRule, ac *AttributeCondition, includeDisabled bool) RemovalReason {
+	a, found := db.Attributes[ac.AttributeID]
+	if !found {
+		return RemovedUnknownAttribute
+	}
+	if !containsInt(rule.AttributeIDs, a.ID) {
+		return RemovedAttributeNotInCategory
+	}
+	o, found := db.Options[ac.OptionID]
+	if !found || o.AttributeID != a.ID {
+		return RemovedOptionNotVisible
+	}
+	if (a.IsDisabled || o.IsDisabled) && !includeDisabled {
+		return RemovedDisabled
+	}
+	return RemovedOptionNotVisible
+}
+
+// Explains why each of the selected options in the response was removed.
+func (db *DB) explainRemovedAll(rule *CategoryRule, res *FindVisibleAttributesResponse) {
+	for _, rc := range res.Removed {
+		rc.Explanation = db.explainRemoved(rule, rc)
+	}
+}
+
+// Refers to an attribute or option by its int ID, or by the UUID the client
+// passed if it's unknown (resolved to ID 0).
+func conditionRef(id int, uuid string) string {
+	if id == 0 && uuid != "" {
+		return uuid
+	}
+	return strconv.Itoa(id)
+}
+
+// Explains why a selected option was removed.
+func (db *DB) explainRemoved(rule *CategoryRule, rc *RemovedCondition) *Explanation {
+	e := &Explanation{Reason: string(rc.Reason)}
+
+	a := db.Attributes[rc.AttributeID]
+	o := db.Options[rc.OptionID]
+
+	title := db.conditionTitle(rc.AttributeID, rc.OptionID)
+
+	switch rc.Reason {
+	case RemovedDuplicate:
+		e.Message = fmt.Sprintf("%s is selected more than once", title)
+	case RemovedSingleSelectConflict:
+		e.Message = fmt.Sprintf("%s allows only one option to be selected", a.Title)
+	case RemovedUnknownAttribute:
+		e.Message = fmt.Sprintf("attribute %s does not exist", conditionRef(rc.AttributeID, rc.AttributeUUID))
+	case RemovedAttributeNotInCategory:
+		e.Message = fmt.Sprintf("%s is not an attribute of the selected categories", a.Title)
+	case RemovedDisabled:
+		e.Message = fmt.Sprintf("%s is disabled", title)
+	default:
+		if o == nil || o.AttributeID != rc.AttributeID {
+			e.Message = fmt.Sprintf("option %s is not an option of %s", conditionRef(rc.OptionID, rc.OptionUUID), a.Title)
+			break
+		}
+
+		// List the options that would reveal it
+		var by []string
+		for selectedOptionID := range rule.ShowIfOptionIDSelected {
+			if lo := rule.limitedOptions(selectedOptionID, a.ID); lo != nil && containsInt(lo.OptionIDs, o.ID) {
+				if so, found := db.Options[selectedOptionID]; found {
+					by = append(by, db.conditionTitle(so.AttributeID, so.ID))
+				}
+			}
+		}
+		if len(by) == 0 {
+			e.Message = fmt.Sprintf("%s is not visible in the selected categories", title)
+			break
+		}
+		sort.Strings(by)
+		if len(by) > 5 {
+			by = append(by[:5], fmt.Sprintf("%d more", len(by)-5))
+		}
+		e.Message = fmt.Sprintf("%s is only visible when one of %s is selected", title, strings.Join(by, ", "))
+	}
+
+	return e
+}
+
+// E.g. ブランド - シャネル
+func (db *DB) conditionTitle(attributeID, optionID int) string {
+	a, foundA := db.Attributes[attributeID]
+	o, foundO := db.Options[optionID]
+	if !foundA || !foundO {
+		return fmt.Sprintf("attribute %d - option %d", attributeID, optionID)
+	}
+	return a.Title + " - " + o.Title
+}
@@ -0,0 +1,108 @@
+package attribute
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var ErrInvalidFilter = errors.New("invalid option filter")
+
+// MatchMode decides how an option filter query is matched against option
+// titles (and subtitles).
+type MatchMode string
+
+const (
+	MatchPrefix   MatchMode = "prefix"
+	MatchContains MatchMode = "contains"
+)
+
+// Fold normalizes text for matching, e.g. so that "ｼｬﾈﾙ", "しゃねる" and
+// "シャネル" or "ＣＨＡＮＥＬ" and "chanel" are treated as equal.
+// Full-width alphanumerics become half-width, half-width katakana becomes
+// full-width, hiragana becomes katakana and all letters are lower-cased.
+func Fold(s string) string {
+	s = norm.NFKC.String(s)
+	return strings.Map(func(r rune) rune {
+		if r >= 'ぁ' && r <= 'ゖ' {
+			// Hiragana to katakana
+			return r + ('ァ' - 'ぁ')
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// Folded option titles and subtitles are computed once after import,
+// see PostProcessImportedData.
+func (o *Option) foldText() {
+	o.foldedTitle = Fold(o.Title)
+	o.foldedSubtitle = Fold(o.Subtitle)
+}
+
+type compiledFilter struct {
+	*OptionFilter
+	query string
+}
+
+func (f *compiledFilter) matches(title, subtitle string) bool {
+	if f.Match == MatchContains {
+		return strings.Contains(title, f.query) || (f.Subtitle && strings.Contains(subtitle, f.query))
+	}
+	return strings.HasPrefix(title, f.query) || (f.Subtitle && strings.HasPrefix(subtitle, f.query))
+}
+
+// Option filters grouped by the attribute they apply to.
+type optionMatcher map[int][]*compiledFilter // key = attribute ID
+
+func newOptionMatcher(filters []*OptionFilter) (optionMatcher, error) {
+	m := make(optionMatcher)
+
+	for _, f := range filters {
+		if f == nil {
+			continue
+		}
+
+		switch f.Match {
+		case "", MatchPrefix, MatchContains:
+		default:
+			return nil, fmt.Errorf("%w: unknown match mode '%s' for attribute %d", ErrInvalidFilter, f.Match, f.AttributeID)
+		}
+
+		query := f.Query
+		if query == "" {
+			query = f.Prefix
+		}
+		if query == "" {
+			// Nothing to filter on
+			continue
+		}
+		if f.Fold {
+			query = Fold(query)
+		}
+
+		m[f.AttributeID] = append(m[f.AttributeID], &compiledFilter{OptionFilter: f, query: query})
+	}
+
+	return m, nil
+}
+
+// Matches returns true if the option passes all filters set for its attribute.
+func (m optionMatcher) Matches(o *Option) bool {
+	for _, f := range m[o.AttributeID] {
+		title, subtitle := o.Title, o.Subtitle
+		if f.Fold {
+			title, subtitle = o.foldedTitle, o.foldedSubtitle
+			if title == "" && o.Title != "" {
+				// Not folded after import
+				title, subtitle = Fold(o.Title), Fold(o.Subtitle)
+			}
+		}
+		if !f.matches(title, subtitle) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,25 +1,36 @@
 package attribute
 
 import (
+	"errors"
 	"fmt"
 	"math"
-	"strings"
+)
+
+var (
+	ErrInvalidOffset   = errors.New("invalid offset")
+	ErrInvalidPageSize = errors.New("invalid page size")
 )
 
 func FindVisibleAttributes(sc *SearchConditions, db *DB) (res *FindVisibleAttributesResponse, err error) {
-	res = new(FindVisibleAttributesResponse)
-	res.VAs = make([]*VisibleAttribute, 0)
-	res.Corrected = new(SearchConditions)
+	return FindVisibleAttributesWithCounts(sc, db, nil)
+}
 
-	if len(sc.CategoryIDs) > 1 {
-		err = fmt.Errorf("UNIMPLEMENTED: cannot handle multiple category IDs yet")
-		return
+// FindVisibleAttributesWithCounts is the same as FindVisibleAttributes but
+// uses the counter to count the items using each option when the search
+// conditions ask for counts.
+func FindVisibleAttributesWithCounts(sc *SearchConditions, db *DB, counter OptionCounter) (res *FindVisibleAttributesResponse, err error) {
+	if sc.Offset < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidOffset, sc.Offset)
 	}
-	if len(sc.CategoryIDs) == 0 {
-		// Clear all attributes
-		return
+	if sc.PageSize < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidPageSize, sc.PageSize)
 	}
 
+	res = new(FindVisibleAttributesResponse)
+	res.VAs = make([]*VisibleAttribute, 0)
+	res.Corrected = new(SearchConditions)
+	res.Removed = make([]*RemovedCondition, 0)
+
 	if sc.PageSize == 0 {
 		// Default page size is 100
 		sc.PageSize = 100
@@ -30,171 +41,331 @@ func FindVisibleAttributes(sc *SearchConditions, db *DB) (res *FindVisibleAttrib
 	}
 	res.PageSize = sc.PageSize
 
-	catID := sc.CategoryIDs[0]
+	catIDs := uniqueInts(sc.CategoryIDs)
 
-	res.Corrected.CategoryIDs = []int{catID}
+	res.Corrected.CategoryIDs = catIDs
+	res.Corrected.CategoryMatch = sc.CategoryMatch
 	res.Corrected.PageSize = sc.PageSize
 	res.Corrected.Offset = sc.Offset
-	res.Corrected.Filters = sc.Filters
-
-	selectedAs := make(map[int]bool)
-	selectedOs := make(map[int]bool)
+	res.Corrected.IncludeDisabled = sc.IncludeDisabled
+	res.Corrected.Sort = sc.Sort
+	res.Corrected.OptionDetails = sc.OptionDetails
+	res.Corrected.Counts = sc.Counts
+	res.Corrected.HideEmpty = sc.HideEmpty
+	res.Corrected.Explain = sc.Explain
+
+	// Attributes that don't allow multiple options only keep their
+	// first selection
+	conditions, removed := db.dedupeSelections(sc.Attributes)
+	res.Removed = append(res.Removed, removed...)
+
+	if len(catIDs) == 0 {
+		// Clear all attributes
+		for _, ac := range conditions {
+			res.Removed = append(res.Removed, db.newRemovedCondition(ac, RemovedAttributeNotInCategory))
+		}
+		if sc.Explain {
+			db.explainRemovedAll(new(CategoryRule), res)
+		}
+		return
+	}
 
-	for _, ac := range sc.Attributes {
-		selectedAs[ac.AttributeID] = true
-		selectedOs[ac.OptionID] = true
+	// Combine the rules of all selected categories
+	rule, err := db.MergeCategoryRules(catIDs, sc.CategoryMatch)
+	if err != nil {
+		return nil, err
 	}
 
-	rule := db.CategoryRule(catID)
+	// Each filter applies to the options of its own attribute
+	res.Corrected.Filters, err = db.resolveFilters(sc.Filters)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := newOptionMatcher(res.Corrected.Filters)
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO: Handle multiple option filters
-	var filter *OptionFilter
-	if len(sc.Filters) > 0 {
-		filter = sc.Filters[0]
+	// Options are returned in display order unless the client asked
+	// for another order
+	order, err := db.optionOrder(sc.Sort)
+	if err != nil {
+		return nil, err
 	}
 
-	visibleAs := make(map[int]*VisibleAttribute)
-	visibleOs := make(map[int]bool)
+	// Each attribute starts at the global offset unless the client passed
+	// a cursor for it, e.g. to fetch more brands
+	offsets := make(map[int]int) // key = attribute ID
+	for _, c := range sc.Cursors {
+		attributeID, offset, err := db.decodeCursor(c)
+		if err != nil {
+			return nil, err
+		}
+		offsets[attributeID] = offset
+		res.Corrected.Cursors = append(res.Corrected.Cursors, c)
+	}
+	offsetFor := func(attributeID int) int {
+		if offset, found := offsets[attributeID]; found {
+			return offset
+		}
+		return sc.Offset
+	}
 
 	res.Pages = 1
 
-	// Add visible attributes
-	for _, attributeID := range rule.AlwaysVisibleAttributeIDs {
-		a := db.Attribute(attributeID)
+	var counts map[int]int // key = option ID, see OptionCounter
 
+	addPage := func(a *Attribute, optionIDs []int) error {
 		va := &VisibleAttribute{
 			ID:    a.ID,
+			UUID:  db.UUID(a.ID),
 			Title: a.Title,
 		}
 
-		// All options for this attribute should be visible
-		// but we return max X options per page
-		var offset int
-		var count int
+		shown, err := db.addOptionsPage(va, optionIDs, offsetFor(a.ID), sc, filters, counts)
+		if err != nil {
+			return err
+		}
 
-		if len(a.OptionIDs) > sc.PageSize {
-			pages := int(math.Ceil(float64(len(a.OptionIDs)) / float64(sc.PageSize)))
+		if shown > sc.PageSize {
+			pages := int(math.Ceil(float64(shown) / float64(sc.PageSize)))
 			if res.Pages < pages {
 				// Remember the attribute with the most number option pages
 				res.Pages = pages
 			}
 		}
 
-		for i := offset; i < len(a.OptionIDs); i++ {
-			o := db.Option(a.OptionIDs[i])
-
-			if filter != nil {
-				if filter.AttributeID == a.ID {
-					// Filter matches current attribute, proceed with filtering on `Title`
-					if filter.Prefix != "" {
-						if !strings.HasPrefix(o.Title, filter.Prefix) {
-							// Filtered out!
-							continue
-						}
-					}
-				}
-			}
-
-			va.Os = append(va.Os, &VisibleOption{ID: o.ID, Title: o.Title})
-			visibleOs[o.ID] = true
-
-			count++
-			if count >= sc.PageSize {
-				break
-			}
-		}
-
 		if len(va.Os) > 0 {
-			// Must have at least one visible option to be considered valid
+			// Must have at least one option on this page to be listed
 			res.VAs = append(res.VAs, va)
-			visibleAs[va.ID] = va
 		}
+		return nil
 	}
 
 	// Add options (and their parent attributes) that meet preconditions,
 	// i.e. make additional options visible based on what attributes/options
 	// are currently selected in our search condition.
-	//
-	toAdd := make(map[int][]int) // key = attribute ID
-
-	for selectedOptionID := range selectedOs {
-		if limitedOptions, found := rule.ShowIfOptionIDSelected[selectedOptionID]; found {
-			for _, lo := range limitedOptions {
-				if optionIDs, found := toAdd[lo.AttributeID]; found {
-					// replace options if this set is smaller!
-					if len(lo.OptionIDs) < len(optionIDs) {
-						toAdd[lo.AttributeID] = lo.OptionIDs
-					}
-				} else {
-					toAdd[lo.AttributeID] = lo.OptionIDs
-				}
-			}
+	active, revealed := db.resolveSelections(rule, conditions, sc.IncludeDisabled)
+
+	// Clean out invalid attribute conditions, including selections whose
+	// chain of preconditions is broken
+	for _, sac := range conditions {
+		if containsInt(active[sac.AttributeID], sac.OptionID) {
+			res.Corrected.Attributes = append(res.Corrected.Attributes, sac)
+		} else {
+			res.Removed = append(res.Removed, db.newRemovedCondition(sac, db.removalReason(rule, sac, sc.IncludeDisabled)))
 		}
 	}
 
-	for attributeID, optionIDs := range toAdd {
-		a := db.Attribute(attributeID)
+	visible, err := db.visibleAttributes(rule, revealed, sc.IncludeDisabled)
+	if err != nil {
+		return nil, err
+	}
 
-		va := &VisibleAttribute{
-			ID:    a.ID,
-			Title: a.Title,
+	// Count items per option of visible attributes for the corrected
+	// search conditions
+	if sc.Counts || sc.HideEmpty {
+		if counter == nil {
+			return nil, ErrNoOptionCounter
+		}
+		ca := &CountOptionsArgs{DB: db, CategoryIDs: catIDs, Selected: res.Corrected.Attributes}
+		for _, v := range visible {
+			ca.AttributeIDs = append(ca.AttributeIDs, v.Attribute.ID)
+		}
+		counts, err = counter.CountOptions(ca)
+		if err != nil {
+			return nil, err
+		}
+		if counts == nil {
+			counts = make(map[int]int)
+		}
+	}
+
+	for _, v := range visible {
+		// All options of always visible attributes should be visible
+		// but we return max X options per page
+		optionIDs := order.attributeOptionIDs(v.Attribute)
+		if !v.AlwaysVisible {
+			optionIDs = order.sort(v.OptionIDs)
+		}
+
+		if err = addPage(v.Attribute, optionIDs); err != nil {
+			return nil, err
 		}
+	}
+
+	if sc.Explain {
+		// Tell support why things are (not) visible
+		db.explainVisible(res, rule, catIDs, active)
+		db.explainRemovedAll(rule, res)
+	}
 
-		res.VAs = append(res.VAs, va)
-		visibleAs[a.ID] = va
+	return
+}
 
-		for _, optionID := range optionIDs {
-			o := db.Option(optionID)
+// Returns the options revealed by the selected options, keyed by attribute ID.
+// Selections of the same attribute reveal the union of their options (OR),
+// selections of different attributes only the options they all reveal (AND).
+// Selections that don't reveal an attribute don't limit its options.
+func (db *DB) revealedOptions(rule *CategoryRule, selectedOs map[int][]int) map[int][]int {
+	revealed := make(map[int][]int) // key = attribute ID
+
+	for attributeID, optionIDs := range selectedOs {
+		union := make(map[int][]int) // key = revealed attribute ID
+		for _, selectedOptionID := range optionIDs {
+			if o, found := db.Options[selectedOptionID]; !found || o.AttributeID != attributeID {
+				// Only valid selections reveal options
+				continue
+			}
+			for _, lo := range rule.ShowIfOptionIDSelected[selectedOptionID] {
+				union[lo.AttributeID] = append(union[lo.AttributeID], lo.OptionIDs...)
+			}
+		}
 
-			va.Os = append(va.Os, &VisibleOption{ID: o.ID, Title: o.Title})
-			visibleOs[o.ID] = true
+		for revealedID, optionIDs := range union {
+			optionIDs = uniqueInts(optionIDs)
+			if current, found := revealed[revealedID]; found {
+				revealed[revealedID] = intersectInts(current, optionIDs)
+			} else {
+				revealed[revealedID] = optionIDs
+			}
 		}
 	}
 
-	// Clean out invalid attribute conditions
-	for _, sac := range sc.Attributes {
-		isValidA := visibleAs[sac.AttributeID]
-		isValidO := visibleOs[sac.OptionID]
-		if isValidA != nil && isValidO {
-			res.Corrected.Attributes = append(res.Corrected.Attributes, sac)
+	for _, optionIDs := range revealed {
+		db.sortOptionIDs(optionIDs)
+	}
+
+	return revealed
+}
+
+// Adds a page of options to the visible attribute and sets a cursor pointing
+// to the next page if there is one. Only options shown count towards pages and
+// the given offset, i.e. not disabled options, options filtered out or options
+// without items in hide empty mode. Returns the number of options shown over
+// all pages.
+//
+// Options are annotated with counts if given.
+func (db *DB) addOptionsPage(va *VisibleAttribute, optionIDs []int, offset int, sc *SearchConditions, filters optionMatcher, counts map[int]int) (shown int, err error) {
+	for _, optionID := range optionIDs {
+		o, err := db.Option(optionID)
+		if err != nil {
+			return 0, err
+		}
+
+		if o.IsDisabled && !sc.IncludeDisabled {
+			continue
+		}
+
+		if !filters.Matches(o) {
+			// Filtered out!
+			continue
+		}
+
+		if sc.HideEmpty && counts[o.ID] == 0 {
+			continue
 		}
+
+		i := shown
+		shown++
+
+		if i < offset {
+			// On an earlier page
+			continue
+		}
+		if len(va.Os) >= sc.PageSize {
+			if va.NextCursor == "" {
+				// There's at least one more option to show on the next page
+				va.NextCursor = db.encodeCursor(va.ID, i)
+			}
+			continue
+		}
+
+		vo := &VisibleOption{ID: o.ID, UUID: db.UUID(o.ID), Title: o.Title}
+		if sc.OptionDetails {
+			vo.Color = o.RGB
+			vo.Subtitle = o.Subtitle
+		}
+		if counts != nil {
+			count := counts[o.ID]
+			vo.Count = &count
+		}
+		va.Os = append(va.Os, vo)
 	}
 
-	return
+	return shown, nil
 }
 
 type FindVisibleAttributesResponse struct {
-	Pages     int
-	PageSize  int
-	VAs       []*VisibleAttribute
-	Corrected *SearchConditions
+	Pages     int                 `json:"pages"` // of the attribute with the most options shown
+	PageSize  int                 `json:"page_size"`
+	VAs       []*VisibleAttribute `json:"visible_attributes"`
+	Corrected *SearchConditions   `json:"corrected"`
+	Removed   []*RemovedCondition `json:"removed"` // selected options removed from the search conditions and why
 }
 
 type SearchConditions struct {
-	CategoryIDs []int                 `json:"category_id"`
-	Attributes  []*AttributeCondition `json:"attributes"`
-	PageSize    int                   `json:"page_size"`
-	Offset      int                   `json:"offset"`
-	Filters     []*OptionFilter       `json:"filters"`
+	CategoryIDs   []int                 `json:"category_id"`
+	CategoryMatch CategoryMatch         `json:"category_match"` // union (default) or intersection of category rules
+	Attributes    []*AttributeCondition `json:"attributes"`
+	PageSize      int                   `json:"page_size"`
+	Offset        int                   `json:"offset"`  // options shown to skip, applies to all attributes without a cursor
+	Cursors       []string              `json:"cursors"` // per attribute cursors, see VisibleAttribute.NextCursor
+	Filters       []*OptionFilter       `json:"filters"`
+	Sort          OptionSort            `json:"sort"` // display_order (default), alphabetical or popularity
+
+	// Admin tools can set this to also see disabled attributes and options
+	IncludeDisabled bool `json:"include_disabled"`
+
+	// Count items per option, see OptionCounter. Hide empty also hides
+	// options without any items.
+	Counts    bool `json:"counts"`
+	HideEmpty bool `json:"hide_empty"`
+
+	// Also return the color and subtitle of options, e.g. to render swatches
+	OptionDetails bool `json:"option_details"`
+
+	// Support tools can set this to learn why attributes and options are
+	// visible and why selected options were removed
+	Explain bool `json:"explain"`
 }
 
 type OptionFilter struct {
-	AttributeID int
-	Prefix      string
+	AttributeID   int       `json:"attribute_id"`
+	AttributeUUID string    `json:"attribute_uuid,omitempty"` // instead of the attribute ID
+	Prefix        string    `json:"prefix"`                   // shorthand for a Query matching title prefixes as is
+	Query         string    `json:"query"`                    // text to match against option titles
+	Match         MatchMode `json:"match"`                    // prefix (default) or contains
+	Fold          bool      `json:"fold"`                     // ignore case, full/half-width and hiragana/katakana differences
+	Subtitle      bool      `json:"subtitle"`                 // also match against option subtitles
 }
 
+// AttributeCondition is a selected option. Options can be selected by int IDs
+// or UUIDs, which stay the same across imports.
 type AttributeCondition struct {
-	AttributeID int `json:"attribute_id"`
-	OptionID    int `json:"option_id"`
+	AttributeID   int    `json:"attribute_id"`
+	OptionID      int    `json:"option_id"`
+	AttributeUUID string `json:"attribute_uuid,omitempty"`
+	OptionUUID    string `json:"option_uuid,omitempty"`
 }
 
 type VisibleAttribute struct {
-	ID    int              `json:"id"`
-	Title string           `json:"title"`
-	Os    []*VisibleOption `json:"options"`
+	ID         int              `json:"id"`
+	UUID       string           `json:"uuid,omitempty"`
+	Title      string           `json:"title"`
+	Os         []*VisibleOption `json:"options"`
+	NextCursor string           `json:"next_cursor,omitempty"` // pass in SearchConditions.Cursors to get the next page
+
+	Explanation *Explanation `json:"explanation,omitempty"`
 }
 
 type VisibleOption struct {
-	ID    int    `json:"id"`
-	Title string `json:"title"`
+	ID       int    `json:"id"`
+	UUID     string `json:"uuid,omitempty"`
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle,omitempty"` // see SearchConditions.OptionDetails
+	Color    *RGB   `json:"color,omitempty"`
+	Count    *int   `json:"count,omitempty"` // number of items using this option, see SearchConditions.Counts
+
+	Explanation *Explanation `json:"explanation,omitempty"`
 }
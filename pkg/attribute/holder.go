@@ -0,0 +1,120 @@
+package attribute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrReloadInProgress = errors.New("reload already in progress")
+
+// LoadFunc builds a new DB, e.g. by importing the Postgres CSV files
+// or loading a snapshot.
+type LoadFunc func() (*DB, error)
+
+// Version is an immutable, loaded version of the attribute DB.
+type Version struct {
+	DB       *DB
+	Number   int64     // incremented on every successful reload
+	ETag     string    // changes whenever a new DB is swapped in
+	LoadedAt time.Time // when this version finished loading
+}
+
+// Holder holds the current version of the attribute DB and can reload it
+// without downtime: a new DB is built next to the current one and swapped in
+// atomically once ready. Callers that got a version from Current keep using
+// it until they're done, so in-flight requests finish on the old DB.
+type Holder struct {
+	current   atomic.Pointer[Version]
+	load      LoadFunc
+	reloadMu  sync.Mutex
+	reloading atomic.Bool
+}
+
+// NewHolder loads the first version of the DB using the given function.
+func NewHolder(load LoadFunc) (*Holder, error) {
+	h := &Holder{load: load}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Current returns the current version of the DB.
+func (h *Holder) Current() *Version {
+	return h.current.Load()
+}
+
+// Reload builds a new DB and swaps it in, keeping the current version if
+// loading fails. Returns ErrReloadInProgress if another reload is running.
+func (h *Holder) Reload() error {
+	if !h.reloadMu.TryLock() {
+		return ErrReloadInProgress
+	}
+	defer h.reloadMu.Unlock()
+
+	h.reloading.Store(true)
+	defer h.reloading.Store(false)
+
+	start := time.Now()
+
+	db, err := h.load()
+	if err != nil {
+		return fmt.Errorf("reload failed: %w", err)
+	}
+
+	var number int64 = 1
+	if prev := h.current.Load(); prev != nil {
+		number = prev.Number + 1
+	}
+
+	v := &Version{
+		DB:       db,
+		Number:   number,
+		LoadedAt: time.Now(),
+	}
+	v.ETag = fmt.Sprintf(`"%d-%x"`, v.Number, v.LoadedAt.UnixNano())
+
+	h.current.Store(v)
+
+	fmt.Printf("Swapped in attributes DB version %d (etag: %s) after %s\n", v.Number, v.ETag, time.Since(start))
+
+	return nil
+}
+
+// IsReloading returns true while a reload is running.
+func (h *Holder) IsReloading() bool {
+	return h.reloading.Load()
+}
+
+// ReloadInBackground starts a reload on a separate goroutine and returns
+// immediately. The optional callback receives the result.
+func (h *Holder) ReloadInBackground(done func(err error)) {
+	go func() {
+		err := h.Reload()
+		if done != nil {
+			done(err)
+		}
+	}()
+}
+
+// ReloadEvery reloads the DB at the given interval until the context is
+// cancelled. Failed reloads are logged and retried on the next tick.
+func (h *Holder) ReloadEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := h.Reload(); err != nil {
+				fmt.Printf("WARN: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package attribute
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ListingError tells what's wrong with an attribute of a listing, see
+// ValidateListing.
+type ListingError string
+
+const (
+	// A required attribute has no option selected
+	ListingErrorRequired ListingError = "required"
+	// More than one option selected for an attribute that allows only one
+	ListingErrorSingleSelect ListingError = "single_select"
+	// The attribute doesn't exist or isn't used by the category
+	ListingErrorUnknownAttribute ListingError = "unknown_attribute"
+	// The attribute or option is disabled
+	ListingErrorDisabled ListingError = "disabled"
+	// The option doesn't exist, belongs to another attribute or is only
+	// visible when other options are selected
+	ListingErrorNotVisible ListingError = "not_visible"
+)
+
+type ListingValidation struct {
+	Valid  bool          `json:"valid"`
+	Errors []*FieldError `json:"errors"` // in the same order as the listing form
+}
+
+// FieldError is an error for a single attribute (field) of the sell form.
+type FieldError struct {
+	AttributeID    int          `json:"attribute_id"`
+	AttributeUUID  string       `json:"attribute_uuid,omitempty"`
+	AttributeTitle string       `json:"attribute_title"`
+	OptionID       int          `json:"option_id,omitempty"` // the invalid selected option, if any
+	OptionUUID     string       `json:"option_uuid,omitempty"`
+	Error          ListingError `json:"error"`
+	Message        string       `json:"message"`
+}
+
+// ValidateListing checks the options selected for a listing in the given
+// category: required attributes must have an option selected, selected options
+// must be visible given the other selected options, and single-select
+// attributes can only have one option selected.
+func (db *DB) ValidateListing(categoryID int, selected []*AttributeCondition) (*ListingValidation, error) {
+	rule, err := db.CategoryRule(categoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions, removed := db.dedupeSelections(selected)
+	active, revealed := db.resolveSelections(rule, conditions, false)
+
+	res := &ListingValidation{Errors: make([]*FieldError, 0)}
+
+	for _, rc := range removed {
+		if rc.Reason == RemovedDuplicate {
+			// Harmless
+			continue
+		}
+		fe := db.newFieldError(rc.AttributeID, rc.OptionID, listingError(rc.Reason))
+		// Unknown selections are known by the UUIDs passed
+		fe.AttributeUUID, fe.OptionUUID = rc.AttributeUUID, rc.OptionUUID
+		res.Errors = append(res.Errors, fe)
+	}
+
+	for _, ac := range conditions {
+		if containsInt(active[ac.AttributeID], ac.OptionID) {
+			continue
+		}
+		e := listingError(db.removalReason(rule, ac, false))
+		res.Errors = append(res.Errors, db.newFieldError(ac.AttributeID, ac.OptionID, e))
+	}
+
+	visible, err := db.visibleAttributes(rule, revealed, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range visible {
+		if v.Attribute.IsRequired && len(active[v.Attribute.ID]) == 0 {
+			res.Errors = append(res.Errors, db.newFieldError(v.Attribute.ID, 0, ListingErrorRequired))
+		}
+	}
+
+	// Show errors in the same order as the fields of the sell form
+	sort.SliceStable(res.Errors, func(i, j int) bool {
+		id1, id2 := res.Errors[i].AttributeID, res.Errors[j].AttributeID
+		return id1 != id2 && db.attributeLess(id1, id2)
+	})
+
+	res.Valid = len(res.Errors) == 0
+
+	return res, nil
+}
+
+// Returns the listing error for a selected option removed for the reason.
+func listingError(reason RemovalReason) ListingError {
+	switch reason {
+	case RemovedSingleSelectConflict:
+		return ListingErrorSingleSelect
+	case RemovedUnknownAttribute, RemovedAttributeNotInCategory:
+		return ListingErrorUnknownAttribute
+	case RemovedDisabled:
+		return ListingErrorDisabled
+	default:
+		return ListingErrorNotVisible
+	}
+}
+
+func (db *DB) newFieldError(attributeID, optionID int, e ListingError) *FieldError {
+	fe := &FieldError{
+		AttributeID:   attributeID,
+		AttributeUUID: db.UUID(attributeID),
+		OptionID:      optionID,
+		OptionUUID:    db.UUID(optionID),
+		Error:         e,
+	}
+
+	title := fmt.Sprintf("attribute %d", attributeID)
+	if a, found := db.Attributes[attributeID]; found {
+		title = a.Title
+		fe.AttributeTitle = a.Title
+	}
+
+	switch e {
+	case ListingErrorRequired:
+		fe.Message = fmt.Sprintf("%s is required", title)
+	case ListingErrorSingleSelect:
+		fe.Message = fmt.Sprintf("only one %s can be selected", title)
+	case ListingErrorUnknownAttribute:
+		fe.Message = fmt.Sprintf("%s can not be used in this category", title)
+	case ListingErrorDisabled:
+		fe.Message = fmt.Sprintf("%s is no longer available", db.conditionTitle(attributeID, optionID))
+	default:
+		fe.Message = fmt.Sprintf("%s can not be selected", db.conditionTitle(attributeID, optionID))
+	}
+
+	return fe
+}
+
+// FormLayout is the sell form for a category: its fields (attributes) grouped
+// by page.
+type FormLayout struct {
+	CategoryID int         `json:"category_id"`
+	Pages      []*FormPage `json:"pages"`
+}
+
+type FormPage struct {
+	Page   int          `json:"page"` // see Attribute.DisplayPage
+	Fields []*FormField `json:"fields"`
+}
+
+type FormField struct {
+	AttributeID   int              `json:"attribute_id"`
+	AttributeUUID string           `json:"attribute_uuid,omitempty"`
+	Title         string           `json:"title"`
+	Widget        string           `json:"widget"` // see Attribute.ListingType, e.g. single_select
+	Required      bool             `json:"required"`
+	Multiple      bool             `json:"multiple"` // more than one option can be selected
+	Options       []*VisibleOption `json:"options"`
+	Selected      []int            `json:"selected"` // selected option IDs in effect
+}
+
+// FormLayout returns the fields of the sell form for the given category and
+// selected options, using the same visibility rules as FindVisibleAttributes:
+// fields revealed by selected options are included, and selections that are
+// not in effect are ignored.
+func (db *DB) FormLayout(categoryID int, selected []*AttributeCondition) (*FormLayout, error) {
+	rule, err := db.CategoryRule(categoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions, _ := db.dedupeSelections(selected)
+	active, revealed := db.resolveSelections(rule, conditions, false)
+
+	visible, err := db.visibleAttributes(rule, revealed, false)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &FormLayout{CategoryID: categoryID, Pages: make([]*FormPage, 0)}
+
+	// Visible attributes are ordered by page already
+	var page *FormPage
+	for _, v := range visible {
+		a := v.Attribute
+
+		f := &FormField{
+			AttributeID:   a.ID,
+			AttributeUUID: db.UUID(a.ID),
+			Title:         a.Title,
+			Widget:        a.ListingType,
+			Required:      a.IsRequired,
+			Multiple:      a.IsMultipleAllowed,
+			Options:       make([]*VisibleOption, 0, len(v.OptionIDs)),
+			Selected:      make([]int, 0),
+		}
+		if f.Widget == "" {
+			f.Widget = "single_select"
+			if a.IsMultipleAllowed {
+				f.Widget = "multi_select"
+			}
+		}
+
+		for _, optionID := range v.OptionIDs {
+			o, err := db.Option(optionID)
+			if err != nil {
+				return nil, err
+			}
+			if o.IsDisabled {
+				continue
+			}
+			f.Options = append(f.Options, &VisibleOption{ID: o.ID, UUID: db.UUID(o.ID), Title: o.Title, Subtitle: o.Subtitle, Color: o.RGB})
+		}
+		if len(f.Options) == 0 {
+			continue
+		}
+
+		for _, ac := range conditions {
+			if ac.AttributeID == a.ID && containsInt(active[a.ID], ac.OptionID) {
+				f.Selected = append(f.Selected, ac.OptionID)
+			}
+		}
+
+		if page == nil || page.Page != a.DisplayPage {
+			page = &FormPage{Page: a.DisplayPage}
+			res.Pages = append(res.Pages, page)
+		}
+		page.Fields = append(page.Fields, f)
+	}
+
+	return res, nil
+}
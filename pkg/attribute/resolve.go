@@ -0,0 +1,211 @@
+package attribute
+
+import (
+	"sort"
+	"strings"
+)
+
+// Drops duplicate selections and extra selections of attributes that don't
+// allow multiple options, keeping the first selection. Selections by UUID are
+// resolved to int IDs first, and selections of unknown attributes or options
+// are dropped before they can be taken for duplicates or conflicts.
+func (db *DB) dedupeSelections(acs []*AttributeCondition) (conditions []*AttributeCondition, removed []*RemovedCondition) {
+	selectedOs := make(map[int][]int) // key = attribute ID
+
+	for _, ac := range acs {
+		ac, reason := db.resolveCondition(ac)
+		if reason != "" {
+			removed = append(removed, db.newRemovedCondition(ac, reason))
+			continue
+		}
+		if containsInt(selectedOs[ac.AttributeID], ac.OptionID) {
+			removed = append(removed, db.newRemovedCondition(ac, RemovedDuplicate))
+			continue
+		}
+		if a := db.Attributes[ac.AttributeID]; !a.IsMultipleAllowed && len(selectedOs[a.ID]) > 0 {
+			removed = append(removed, db.newRemovedCondition(ac, RemovedSingleSelectConflict))
+			continue
+		}
+		selectedOs[ac.AttributeID] = append(selectedOs[ac.AttributeID], ac.OptionID)
+		conditions = append(conditions, ac)
+	}
+
+	return
+}
+
+// Resolves which of the selected options are in effect. Options revealed by a
+// selection can themselves be preconditions for more options (e.g. brand ->
+// model line -> model), so a selection only counts when it's visible given the
+// other selections in effect. Starting from no selections, visible selections
+// are added until nothing changes (a fixed point).
+//
+// Since selections of different attributes reveal only the options they have
+// in common, adding a selection can also hide another, and the selections in
+// effect can flip back and forth forever. When that happens only the
+// selections that stay in effect are kept.
+//
+// Returns the selections in effect, grouped by attribute, and the options they
+// reveal, see revealedOptions.
+func (db *DB) resolveSelections(rule *CategoryRule, conditions []*AttributeCondition, includeDisabled bool) (active, revealed map[int][]int) {
+	state := make([]bool, len(conditions)) // true if in effect
+	seen := make(map[string]int)           // key = state, value = iteration
+
+	selectionsOf := func(state []bool) map[int][]int {
+		selected := make(map[int][]int) // key = attribute ID
+		for i, ac := range conditions {
+			if state[i] {
+				selected[ac.AttributeID] = append(selected[ac.AttributeID], ac.OptionID)
+			}
+		}
+		return selected
+	}
+
+	next := func(state []bool) []bool {
+		revealed := db.revealedOptions(rule, selectionsOf(state))
+		res := make([]bool, len(conditions))
+		for i, ac := range conditions {
+			res[i] = db.isSelectable(rule, ac, revealed, includeDisabled)
+		}
+		return res
+	}
+
+	var history [][]bool
+	for i := 0; ; i++ {
+		key := stateKey(state)
+		if first, found := seen[key]; found {
+			// Oscillating between states, only keep the selections in
+			// effect in all of them
+			for _, s := range history[first:] {
+				for j := range state {
+					state[j] = state[j] && s[j]
+				}
+			}
+			state = shrinkSelections(state, next)
+			break
+		}
+		seen[key] = i
+		history = append(history, state)
+
+		n := next(state)
+		if stateKey(n) == key {
+			// Fixed point
+			break
+		}
+		state = n
+	}
+
+	active = selectionsOf(state)
+	revealed = db.revealedOptions(rule, active)
+
+	return
+}
+
+// Drops selections that aren't visible given the remaining selections, until
+// all remaining selections are visible. Never adds selections, so it always
+// terminates.
+func shrinkSelections(state []bool, next func([]bool) []bool) []bool {
+	for {
+		n := next(state)
+		var changed bool
+		for i := range state {
+			if state[i] && !n[i] {
+				state[i] = false
+				changed = true
+			}
+		}
+		if !changed {
+			return state
+		}
+	}
+}
+
+func stateKey(state []bool) string {
+	var sb strings.Builder
+	for _, b := range state {
+		if b {
+			sb.WriteByte('1')
+		} else {
+			sb.WriteByte('0')
+		}
+	}
+	return sb.String()
+}
+
+// Returns true if the selected option can be selected given the options
+// revealed by other selections.
+func (db *DB) isSelectable(rule *CategoryRule, ac *AttributeCondition, revealed map[int][]int, includeDisabled bool) bool {
+	a, found := db.Attributes[ac.AttributeID]
+	if !found || (a.IsDisabled && !includeDisabled) {
+		return false
+	}
+	o, found := db.Options[ac.OptionID]
+	if !found || o.AttributeID != a.ID || (o.IsDisabled && !includeDisabled) {
+		return false
+	}
+
+	if rule.isAlwaysVisible(a.ID) {
+		// All options of this attribute are visible
+		return true
+	}
+
+	return containsInt(revealed[a.ID], o.ID)
+}
+
+// An attribute visible given the selected options.
+type visibleAttribute struct {
+	Attribute     *Attribute
+	AlwaysVisible bool  // all options are visible
+	OptionIDs     []int // options revealed by selected options, in display order
+}
+
+// Returns the attributes visible given the options revealed by selected
+// options, see resolveSelections, in the same order as in the listing form.
+func (db *DB) visibleAttributes(rule *CategoryRule, revealed map[int][]int, includeDisabled bool) ([]*visibleAttribute, error) {
+	var res []*visibleAttribute
+
+	for _, attributeID := range rule.AlwaysVisibleAttributeIDs {
+		a, err := db.Attribute(attributeID)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(a.OptionIDs) == 0 {
+			// Must have at least one visible option to be considered valid
+			continue
+		}
+		if a.IsDisabled && !includeDisabled {
+			continue
+		}
+
+		res = append(res, &visibleAttribute{Attribute: a, AlwaysVisible: true, OptionIDs: a.OptionIDs})
+	}
+
+	for attributeID, optionIDs := range revealed {
+		if rule.isAlwaysVisible(attributeID) {
+			// Already visible with all of its options
+			continue
+		}
+		if len(optionIDs) == 0 {
+			// The selections don't have any revealed options in common
+			continue
+		}
+
+		a, err := db.Attribute(attributeID)
+		if err != nil {
+			return nil, err
+		}
+		if a.IsDisabled && !includeDisabled {
+			continue
+		}
+
+		res = append(res, &visibleAttribute{Attribute: a, OptionIDs: optionIDs})
+	}
+
+	// Always visible attributes and attributes revealed by selected options
+	// are shown together
+	sort.Slice(res, func(i, j int) bool {
+		return db.attributeLess(res[i].Attribute.ID, res[j].Attribute.ID)
+	})
+
+	return res, nil
+}
@@ -0,0 +1,306 @@
+package attribute
+
+import "sort"
+
+// CategoryMatch decides how the rules of multiple selected categories are
+// combined.
+type CategoryMatch string
+
+const (
+	// Show attributes and options visible in any of the selected categories
+	CategoryMatchUnion CategoryMatch = "union"
+	// Show only attributes and options visible in all of the selected categories
+	CategoryMatchIntersection CategoryMatch = "intersection"
+)
+
+// MergeCategoryRules combines the rules for the given categories into a
+// single rule, e.g. when a buyer selects several sibling categories at once.
+// A single category returns its own rule as is.
+func (db *DB) MergeCategoryRules(categoryIDs []int, m CategoryMatch) (*CategoryRule, error) {
+	var rules []*CategoryRule
+	for _, id := range categoryIDs {
+		r, err := db.CategoryRule(id)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	if len(rules) == 1 {
+		return rules[0], nil
+	}
+
+	var merged *CategoryRule
+	if m == CategoryMatchIntersection {
+		merged = intersectCategoryRules(rules)
+	} else {
+		merged = unionCategoryRules(rules)
+	}
+
+	db.sortAttributeIDs(merged.AttributeIDs)
+	db.sortAttributeIDs(merged.AlwaysVisibleAttributeIDs)
+
+	return merged, nil
+}
+
+// Resolves a rule for a category without a rule of its own: the rule of its
+// nearest ancestor, or if no ancestor has a rule (e.g. a parent category like
+// レディース - 小物), the attributes common to all of its descendants.
+// Categories with neither get an empty rule.
+// Must be called with inheritedRulesMu held.
+func (db *DB) inheritCategoryRule(c *Category) *CategoryRule {
+	for i := len(c.Path) - 1; i >= 0; i-- {
+		if r, found := db.CategoryRules[c.Path[i]]; found {
+			return r
+		}
+	}
+
+	if db.categoryChildren == nil {
+		db.categoryChildren = make(map[int][]int)
+		for _, cc := range db.CategoryTree {
+			db.categoryChildren[cc.ParentID] = append(db.categoryChildren[cc.ParentID], cc.ID)
+		}
+		for _, ids := range db.categoryChildren {
+			sort.Ints(ids)
+		}
+	}
+
+	// Find the nearest descendants with rules of their own
+	var rules []*CategoryRule
+	queue := append([]int{}, db.categoryChildren[c.ID]...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		if r, found := db.CategoryRules[id]; found {
+			rules = append(rules, r)
+			continue
+		}
+		queue = append(queue, db.categoryChildren[id]...)
+	}
+
+	var merged *CategoryRule
+	switch len(rules) {
+	case 0:
+		merged = newMergedCategoryRule()
+	case 1:
+		return rules[0]
+	default:
+		merged = intersectCategoryRules(rules)
+		db.sortAttributeIDs(merged.AttributeIDs)
+		db.sortAttributeIDs(merged.AlwaysVisibleAttributeIDs)
+	}
+
+	merged.CategoryID = c.ID
+
+	return merged
+}
+
+func newMergedCategoryRule() *CategoryRule {
+	return &CategoryRule{
+		ShowIfOptionIDSelected: make(map[int][]*LimitedOptions),
+		ShowOptionIDAlways:     make(map[int]bool),
+	}
+}
+
+func unionCategoryRules(rules []*CategoryRule) *CategoryRule {
+	merged := newMergedCategoryRule()
+
+	hasAttribute := make(map[int]bool)
+	alwaysVisible := make(map[int]bool)
+
+	for _, r := range rules {
+		for _, id := range r.AttributeIDs {
+			if !hasAttribute[id] {
+				hasAttribute[id] = true
+				merged.AttributeIDs = append(merged.AttributeIDs, id)
+			}
+		}
+		for _, id := range r.AlwaysVisibleAttributeIDs {
+			if !alwaysVisible[id] {
+				alwaysVisible[id] = true
+				merged.AlwaysVisibleAttributeIDs = append(merged.AlwaysVisibleAttributeIDs, id)
+			}
+		}
+		for id := range r.ShowOptionIDAlways {
+			merged.ShowOptionIDAlways[id] = true
+		}
+	}
+
+	for _, r := range rules {
+		for selectedOptionID, los := range r.ShowIfOptionIDSelected {
+			for _, lo := range los {
+				if alwaysVisible[lo.AttributeID] {
+					// All options of this attribute are already visible
+					// in at least one of the categories
+					continue
+				}
+				for _, optionID := range lo.OptionIDs {
+					merged.addLimitedOptionID(selectedOptionID, lo.AttributeID, optionID)
+				}
+			}
+		}
+	}
+
+	return merged
+}
+
+func intersectCategoryRules(rules []*CategoryRule) *CategoryRule {
+	merged := newMergedCategoryRule()
+
+	attributeCounts := make(map[int]int)
+	alwaysVisibleCounts := make(map[int]int)
+	showAlwaysCounts := make(map[int]int)
+
+	for _, r := range rules {
+		for _, id := range r.AttributeIDs {
+			attributeCounts[id]++
+		}
+		for _, id := range r.AlwaysVisibleAttributeIDs {
+			alwaysVisibleCounts[id]++
+		}
+		for id := range r.ShowOptionIDAlways {
+			showAlwaysCounts[id]++
+		}
+	}
+
+	for _, id := range rules[0].AttributeIDs {
+		if attributeCounts[id] == len(rules) {
+			merged.AttributeIDs = append(merged.AttributeIDs, id)
+		}
+	}
+	for _, id := range rules[0].AlwaysVisibleAttributeIDs {
+		if alwaysVisibleCounts[id] == len(rules) {
+			merged.AlwaysVisibleAttributeIDs = append(merged.AlwaysVisibleAttributeIDs, id)
+		}
+	}
+	for id, count := range showAlwaysCounts {
+		if count == len(rules) {
+			merged.ShowOptionIDAlways[id] = true
+		}
+	}
+
+	// An attribute that is limited in at least one category is revealed by a
+	// selected option only if that option reveals it in every category where
+	// the attribute is limited. The revealed options are those common to all
+	// those categories.
+	for _, attributeID := range merged.AttributeIDs {
+		if alwaysVisibleCounts[attributeID] == len(rules) {
+			continue
+		}
+
+		// Only options that reveal the attribute in the first category
+		// where it's limited can reveal it in all of them
+		var base *CategoryRule
+		for _, r := range rules {
+			if !r.isAlwaysVisible(attributeID) {
+				base = r
+				break
+			}
+		}
+
+		for selectedOptionID := range base.ShowIfOptionIDSelected {
+			var optionIDs []int
+			var constrained bool
+			revealed := true
+
+			for _, r := range rules {
+				if r.isAlwaysVisible(attributeID) {
+					continue
+				}
+
+				lo := r.limitedOptions(selectedOptionID, attributeID)
+				if lo == nil {
+					revealed = false
+					break
+				}
+
+				if !constrained {
+					optionIDs = append([]int{}, lo.OptionIDs...)
+					constrained = true
+				} else {
+					optionIDs = intersectInts(optionIDs, lo.OptionIDs)
+				}
+			}
+
+			if !revealed {
+				continue
+			}
+
+			for _, optionID := range optionIDs {
+				merged.addLimitedOptionID(selectedOptionID, attributeID, optionID)
+			}
+		}
+	}
+
+	return merged
+}
+
+func (r *CategoryRule) isAlwaysVisible(attributeID int) bool {
+	for _, id := range r.AlwaysVisibleAttributeIDs {
+		if id == attributeID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CategoryRule) limitedOptions(selectedOptionID, attributeID int) *LimitedOptions {
+	for _, lo := range r.ShowIfOptionIDSelected[selectedOptionID] {
+		if lo.AttributeID == attributeID {
+			return lo
+		}
+	}
+	return nil
+}
+
+// Same as AddLimitedOption but skips option IDs that have already been added.
+func (r *CategoryRule) addLimitedOptionID(selectedOptionID, attributeID, optionID int) {
+	lo := r.limitedOptions(selectedOptionID, attributeID)
+	if lo == nil {
+		r.ShowIfOptionIDSelected[selectedOptionID] = append(
+			r.ShowIfOptionIDSelected[selectedOptionID],
+			&LimitedOptions{AttributeID: attributeID, OptionIDs: []int{optionID}},
+		)
+		return
+	}
+	for _, id := range lo.OptionIDs {
+		if id == optionID {
+			return
+		}
+	}
+	lo.OptionIDs = append(lo.OptionIDs, optionID)
+}
+
+func intersectInts(a, b []int) (res []int) {
+	inB := make(map[int]bool, len(b))
+	for _, id := range b {
+		inB[id] = true
+	}
+	for _, id := range a {
+		if inB[id] {
+			res = append(res, id)
+		}
+	}
+	return
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueInts(ids []int) (res []int) {
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			res = append(res, id)
+		}
+	}
+	return
+}
@@ -0,0 +1,414 @@
+package attribute
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/mus-format/mus-go/ord"
+	"github.com/mus-format/mus-go/varint"
+)
+
+// Snapshot layout:
+//
+//	magic (4 bytes) | version (varint) | body (MUS encoded DB) | crc32 of body (4 bytes)
+//
+// Bump SnapshotVersion whenever the encoding of the body changes.
+const (
+	SnapshotMagic   = "AFDB"
+	SnapshotVersion = 2
+)
+
+var (
+	ErrInvalidSnapshot            = errors.New("invalid snapshot")
+	ErrUnsupportedSnapshotVersion = errors.New("unsupported snapshot version")
+)
+
+// SaveSnapshot writes the DB to w in a compact binary format that can be
+// loaded with LoadSnapshot, skipping CSV parsing and post-processing.
+// Call after PreSort to store the DB sorted.
+func (db *DB) SaveSnapshot(w io.Writer) error {
+	// First pass computes the size, second pass writes the bytes
+	sw := new(snapshotWriter)
+	sw.db(db)
+
+	sw.bs = make([]byte, sw.n)
+	sw.n = 0
+	sw.db(db)
+
+	header := append([]byte(SnapshotMagic), make([]byte, varint.SizeInt(SnapshotVersion))...)
+	varint.MarshalInt(SnapshotVersion, header[len(SnapshotMagic):])
+
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(sw.bs))
+
+	for _, b := range [][]byte{header, sw.bs, checksum} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadSnapshot reads a DB written by SaveSnapshot.
+func LoadSnapshot(r io.Reader) (*DB, error) {
+	start := time.Now()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(SnapshotMagic)+1+4 || !bytes.HasPrefix(data, []byte(SnapshotMagic)) {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidSnapshot)
+	}
+	data = data[len(SnapshotMagic):]
+
+	version, n, err := varint.UnmarshalInt(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	if version != SnapshotVersion {
+		return nil, fmt.Errorf("%w: got %d, want %d", ErrUnsupportedSnapshotVersion, version, SnapshotVersion)
+	}
+	data = data[n:]
+
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: missing checksum", ErrInvalidSnapshot)
+	}
+	body, checksum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(checksum) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+
+	sr := &snapshotReader{bs: body}
+	db := sr.db()
+	if sr.err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, sr.err)
+	}
+	if sr.n != len(body) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidSnapshot, len(body)-sr.n)
+	}
+
+	// Rebuild derived data
+	for uuid, id := range db.IDs {
+		db.ReverseIDs[id] = uuid
+	}
+	for _, o := range db.Options {
+		o.foldText()
+		o.parseColor()
+	}
+
+	fmt.Printf("Loaded snapshot (%d attributes, %d options, %d category rules) in %s\n",
+		len(db.Attributes), len(db.Options), len(db.CategoryRules), time.Since(start))
+
+	return db, nil
+}
+
+// Sizes values when bs is nil, marshals them into bs otherwise.
+type snapshotWriter struct {
+	bs []byte
+	n  int
+}
+
+func (w *snapshotWriter) int(v int) {
+	if w.bs == nil {
+		w.n += varint.SizeInt(v)
+	} else {
+		w.n += varint.MarshalInt(v, w.bs[w.n:])
+	}
+}
+
+func (w *snapshotWriter) bool(v bool) {
+	if w.bs == nil {
+		w.n += ord.SizeBool(v)
+	} else {
+		w.n += ord.MarshalBool(v, w.bs[w.n:])
+	}
+}
+
+func (w *snapshotWriter) string(v string) {
+	if w.bs == nil {
+		w.n += ord.SizeString(v)
+	} else {
+		w.n += ord.MarshalString(v, w.bs[w.n:])
+	}
+}
+
+func (w *snapshotWriter) ints(v []int) {
+	w.int(len(v))
+	for _, i := range v {
+		w.int(i)
+	}
+}
+
+// Returns the keys of the map in order. Maps are written in key order so that
+// the same DB is always saved to the same bytes.
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func (w *snapshotWriter) db(db *DB) {
+	w.int(db.IDCounter)
+
+	uuids := make([]string, 0, len(db.IDs))
+	for uuid := range db.IDs {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	w.int(len(uuids))
+	for _, uuid := range uuids {
+		w.string(uuid)
+		w.int(db.IDs[uuid])
+	}
+
+	w.int(len(db.Attributes))
+	for _, id := range sortedKeys(db.Attributes) {
+		w.attribute(db.Attributes[id])
+	}
+
+	w.int(len(db.Options))
+	for _, id := range sortedKeys(db.Options) {
+		w.option(db.Options[id])
+	}
+
+	w.int(len(db.CategoryRules))
+	for _, id := range sortedKeys(db.CategoryRules) {
+		w.categoryRule(db.CategoryRules[id])
+	}
+
+	w.int(len(db.CategoryTree))
+	for _, id := range sortedKeys(db.CategoryTree) {
+		w.category(db.CategoryTree[id])
+	}
+}
+
+func (w *snapshotWriter) attribute(a *Attribute) {
+	w.int(a.ID)
+	w.string(a.Type)
+	w.bool(a.IsMultipleAllowed)
+	w.bool(a.IsRequired)
+	w.bool(a.IsDisabled)
+	w.string(a.Title)
+	w.int(a.DisplayOrder)
+	w.bool(a.IsSearchable)
+	w.string(a.ListingType)
+	w.int(a.DisplayPage)
+	w.ints(a.OptionIDs)
+}
+
+func (w *snapshotWriter) option(o *Option) {
+	w.int(o.ID)
+	w.int(o.AttributeID)
+	w.string(o.Title)
+	w.bool(o.IsDisabled)
+	w.int(o.DisplayOrder)
+	w.string(o.Color)
+	w.string(o.Subtitle)
+	w.int(o.Popularity)
+}
+
+func (w *snapshotWriter) categoryRule(r *CategoryRule) {
+	w.int(r.CategoryID)
+
+	w.int(len(r.ShowIfOptionIDSelected))
+	for _, selectedOptionID := range sortedKeys(r.ShowIfOptionIDSelected) {
+		los := r.ShowIfOptionIDSelected[selectedOptionID]
+		w.int(selectedOptionID)
+		w.int(len(los))
+		for _, lo := range los {
+			w.int(lo.AttributeID)
+			w.ints(lo.OptionIDs)
+		}
+	}
+
+	w.int(len(r.ShowOptionIDAlways))
+	for _, id := range sortedKeys(r.ShowOptionIDAlways) {
+		w.int(id)
+		w.bool(r.ShowOptionIDAlways[id])
+	}
+
+	w.ints(r.AttributeIDs)
+	w.ints(r.AlwaysVisibleAttributeIDs)
+}
+
+func (w *snapshotWriter) category(c *Category) {
+	w.int(c.ID)
+	w.string(c.Name)
+	w.int(c.Order)
+	w.int(c.ParentID)
+	w.ints(c.Path)
+}
+
+// Unmarshals values from bs, stopping at the first error.
+type snapshotReader struct {
+	bs  []byte
+	n   int
+	err error
+}
+
+func (r *snapshotReader) int() (v int) {
+	if r.err != nil {
+		return
+	}
+	var n int
+	v, n, r.err = varint.UnmarshalInt(r.bs[r.n:])
+	r.n += n
+	return
+}
+
+func (r *snapshotReader) bool() (v bool) {
+	if r.err != nil {
+		return
+	}
+	var n int
+	v, n, r.err = ord.UnmarshalBool(r.bs[r.n:])
+	r.n += n
+	return
+}
+
+func (r *snapshotReader) string() (v string) {
+	if r.err != nil {
+		return
+	}
+	var n int
+	v, n, r.err = ord.UnmarshalString(r.bs[r.n:])
+	r.n += n
+	return
+}
+
+// Reads a length, guarding against allocating huge slices or maps
+// for corrupt data (every element takes at least 1 byte).
+func (r *snapshotReader) length() int {
+	l := r.int()
+	if r.err == nil && (l < 0 || l > len(r.bs)-r.n) {
+		r.err = fmt.Errorf("invalid length %d at byte %d", l, r.n)
+		return 0
+	}
+	return l
+}
+
+func (r *snapshotReader) ints() (v []int) {
+	l := r.length()
+	if l == 0 {
+		return
+	}
+	v = make([]int, l)
+	for i := range v {
+		v[i] = r.int()
+	}
+	return
+}
+
+func (r *snapshotReader) db() *DB {
+	db := NewDB()
+
+	db.IDCounter = r.int()
+
+	for i, l := 0, r.length(); i < l; i++ {
+		uuid := r.string()
+		db.IDs[uuid] = r.int()
+	}
+
+	for i, l := 0, r.length(); i < l; i++ {
+		a := r.attribute()
+		db.Attributes[a.ID] = a
+	}
+
+	for i, l := 0, r.length(); i < l; i++ {
+		o := r.option()
+		db.Options[o.ID] = o
+	}
+
+	for i, l := 0, r.length(); i < l; i++ {
+		cr := r.categoryRule()
+		db.CategoryRules[cr.CategoryID] = cr
+	}
+
+	for i, l := 0, r.length(); i < l; i++ {
+		c := r.category()
+		db.CategoryTree[c.ID] = c
+	}
+
+	return db
+}
+
+func (r *snapshotReader) attribute() *Attribute {
+	a := new(Attribute)
+	a.ID = r.int()
+	a.Type = r.string()
+	a.IsMultipleAllowed = r.bool()
+	a.IsRequired = r.bool()
+	a.IsDisabled = r.bool()
+	a.Title = r.string()
+	a.DisplayOrder = r.int()
+	a.IsSearchable = r.bool()
+	a.ListingType = r.string()
+	a.DisplayPage = r.int()
+	a.OptionIDs = r.ints()
+	return a
+}
+
+func (r *snapshotReader) option() *Option {
+	o := new(Option)
+	o.ID = r.int()
+	o.AttributeID = r.int()
+	o.Title = r.string()
+	o.IsDisabled = r.bool()
+	o.DisplayOrder = r.int()
+	o.Color = r.string()
+	o.Subtitle = r.string()
+	o.Popularity = r.int()
+	return o
+}
+
+func (r *snapshotReader) categoryRule() *CategoryRule {
+	cr := &CategoryRule{
+		ShowIfOptionIDSelected: make(map[int][]*LimitedOptions),
+		ShowOptionIDAlways:     make(map[int]bool),
+	}
+	cr.CategoryID = r.int()
+
+	for i, l := 0, r.length(); i < l; i++ {
+		selectedOptionID := r.int()
+		var los []*LimitedOptions
+		for j, m := 0, r.length(); j < m; j++ {
+			lo := new(LimitedOptions)
+			lo.AttributeID = r.int()
+			lo.OptionIDs = r.ints()
+			los = append(los, lo)
+		}
+		cr.ShowIfOptionIDSelected[selectedOptionID] = los
+	}
+
+	for i, l := 0, r.length(); i < l; i++ {
+		id := r.int()
+		cr.ShowOptionIDAlways[id] = r.bool()
+	}
+
+	cr.AttributeIDs = r.ints()
+	cr.AlwaysVisibleAttributeIDs = r.ints()
+	return cr
+}
+
+func (r *snapshotReader) category() *Category {
+	c := new(Category)
+	c.ID = r.int()
+	c.Name = r.string()
+	c.Order = r.int()
+	c.ParentID = r.int()
+	c.Path = r.ints()
+	return c
+}
@@ -0,0 +1,250 @@
+package attribute
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// OptionSort decides the order in which the options of an attribute are
+// returned.
+type OptionSort string
+
+const (
+	// Sort options by display order, then ID (default)
+	OptionSortDisplayOrder OptionSort = "display_order"
+	// Sort options by title using Japanese collation, e.g. for brands
+	OptionSortAlphabetical OptionSort = "alphabetical"
+	// Sort the most used options first, see SetOptionPopularity
+	OptionSortPopularity OptionSort = "popularity"
+)
+
+var ErrInvalidSort = errors.New("invalid sort")
+
+// Options of each attribute in an alternative sort order. Built once per DB
+// and sort mode since sorting all brands on every request is too slow.
+type optionOrder struct {
+	ranks     map[int]int   // key = option ID
+	optionIDs map[int][]int // key = attribute ID
+}
+
+// Sorts option IDs by display order, then ID.
+func (db *DB) sortOptionIDs(ids []int) {
+	if len(ids) > 1 {
+		sort.Slice(ids, func(i, j int) bool {
+			o1, o2 := db.Options[ids[i]], db.Options[ids[j]]
+			if o1 == nil || o2 == nil {
+				// Unknown options go last
+				if o1 == nil && o2 == nil {
+					return ids[i] < ids[j]
+				}
+				return o2 == nil
+			}
+			if o1.DisplayOrder != o2.DisplayOrder {
+				return o1.DisplayOrder < o2.DisplayOrder
+			}
+			return o1.ID < o2.ID
+		})
+	}
+}
+
+// Returns the option order for the given sort mode, or nil when options should
+// be returned in display order (the order of Attribute.OptionIDs).
+func (db *DB) optionOrder(s OptionSort) (*optionOrder, error) {
+	switch s {
+	case "", OptionSortDisplayOrder:
+		return nil, nil
+	case OptionSortAlphabetical, OptionSortPopularity:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSort, s)
+	}
+
+	db.optionOrdersMu.RLock()
+	oo, found := db.optionOrders[s]
+	db.optionOrdersMu.RUnlock()
+	if found {
+		return oo, nil
+	}
+
+	db.optionOrdersMu.Lock()
+	defer db.optionOrdersMu.Unlock()
+
+	if db.optionOrders == nil {
+		db.optionOrders = make(map[OptionSort]*optionOrder)
+	}
+	if oo, found = db.optionOrders[s]; !found {
+		if s == OptionSortAlphabetical {
+			oo = db.newAlphabeticalOptionOrder()
+		} else {
+			oo = db.newOptionOrder(func(o1, o2 *Option) bool {
+				return o1.Popularity > o2.Popularity
+			})
+		}
+		db.optionOrders[s] = oo
+	}
+
+	return oo, nil
+}
+
+func (db *DB) newAlphabeticalOptionOrder() *optionOrder {
+	start := time.Now()
+
+	// Comparing collation keys is a lot faster than comparing strings
+	// using the collator directly
+	c := collate.New(language.Japanese)
+	buf := new(collate.Buffer)
+	keys := make(map[int][]byte, len(db.Options))
+	for _, o := range db.Options {
+		keys[o.ID] = append([]byte{}, c.KeyFromString(buf, o.Title)...)
+		buf.Reset()
+	}
+
+	oo := db.newOptionOrder(func(o1, o2 *Option) bool {
+		return bytes.Compare(keys[o1.ID], keys[o2.ID]) < 0
+	})
+
+	if DebugPrint {
+		fmt.Printf("Sorted %d options alphabetically in %s\n", len(db.Options), time.Since(start))
+	}
+
+	return oo
+}
+
+// Ranks all options using less, falling back to display order and ID for
+// options that are equal.
+func (db *DB) newOptionOrder(less func(o1, o2 *Option) bool) *optionOrder {
+	options := make([]*Option, 0, len(db.Options))
+	for _, o := range db.Options {
+		options = append(options, o)
+	}
+
+	sort.Slice(options, func(i, j int) bool {
+		o1, o2 := options[i], options[j]
+		if less(o1, o2) {
+			return true
+		}
+		if less(o2, o1) {
+			return false
+		}
+		if o1.DisplayOrder != o2.DisplayOrder {
+			return o1.DisplayOrder < o2.DisplayOrder
+		}
+		return o1.ID < o2.ID
+	})
+
+	oo := &optionOrder{
+		ranks:     make(map[int]int, len(options)),
+		optionIDs: make(map[int][]int),
+	}
+	for i, o := range options {
+		oo.ranks[o.ID] = i
+		if _, found := db.Attributes[o.AttributeID]; found {
+			oo.optionIDs[o.AttributeID] = append(oo.optionIDs[o.AttributeID], o.ID)
+		}
+	}
+
+	return oo
+}
+
+// Returns all options of the attribute in this order.
+func (oo *optionOrder) attributeOptionIDs(a *Attribute) []int {
+	if oo == nil {
+		return a.OptionIDs
+	}
+	return oo.optionIDs[a.ID]
+}
+
+// Returns a sorted copy of the given option IDs, e.g. options limited by
+// a precondition.
+func (oo *optionOrder) sort(ids []int) []int {
+	if oo == nil || len(ids) < 2 {
+		return ids
+	}
+	sorted := append([]int{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return oo.ranks[sorted[i]] < oo.ranks[sorted[j]]
+	})
+	return sorted
+}
+
+// SetOptionPopularity sets the popularity of all options, e.g. the number of
+// items using each option. Options missing from counts get a popularity of 0.
+// Call before serving requests, like PreSort.
+func (db *DB) SetOptionPopularity(counts map[int]int) {
+	for _, o := range db.Options {
+		o.Popularity = counts[o.ID]
+	}
+
+	db.optionOrdersMu.Lock()
+	delete(db.optionOrders, OptionSortPopularity)
+	db.optionOrdersMu.Unlock()
+}
+
+// LoadOptionPopularityCSV counts how many items use each option, given a CSV
+// file written by ConvertItemAttributeRelationships, and sets the popularity
+// of all options.
+func (db *DB) LoadOptionPopularityCSV(file string) error {
+	start := time.Now()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cr := csv.NewReader(bufio.NewReader(f))
+	cr.ReuseRecord = true
+
+	counts := make(map[int]int)
+
+	var line, items int
+	for {
+		rec, err := cr.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		line++
+
+		if line == 1 {
+			// Headers
+			continue
+		}
+		items++
+		if len(rec) < 2 || rec[1] == "" {
+			continue
+		}
+
+		// E.g. 12-345|12-346|20-1001
+		for _, pair := range strings.Split(rec[1], "|") {
+			_, option, found := strings.Cut(pair, "-")
+			if !found {
+				return fmt.Errorf("%s line %d: invalid attribute to option pair '%s'", file, line, pair)
+			}
+			optionID, err := strconv.Atoi(option)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %w: '%s'", file, line, ErrInvalidNumber, option)
+			}
+			counts[optionID]++
+		}
+	}
+
+	db.SetOptionPopularity(counts)
+
+	fmt.Printf("Loaded popularity of %d options from %d items in %s\n", len(counts), items, time.Since(start))
+
+	return nil
+}
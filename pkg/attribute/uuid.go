@@ -0,0 +1,89 @@
+package attribute
+
+import "fmt"
+
+// Attributes and options are known outside of this DB by their Postgres UUIDs,
+// while int IDs are assigned on import (see ConvertID) and change between
+// imports. Clients can use either, UUIDs take precedence.
+
+// UUID returns the UUID of the attribute or option, or an empty string if it
+// has none.
+func (db *DB) UUID(id int) string {
+	return db.ReverseIDs[id]
+}
+
+// Returns a copy of the condition with both int IDs and UUIDs set, and why
+// it can't be selected if its attribute or option doesn't exist. Unknown UUIDs
+// result in a zero ID, which is never a valid attribute or option.
+func (db *DB) resolveCondition(ac *AttributeCondition) (res *AttributeCondition, reason RemovalReason) {
+	c := *ac
+	res = &c
+
+	if c.AttributeUUID != "" {
+		id, found := db.IDs[c.AttributeUUID]
+		if !found {
+			reason = RemovedUnknownAttribute
+		}
+		c.AttributeID = id
+	} else {
+		c.AttributeUUID = db.UUID(c.AttributeID)
+	}
+	if c.OptionUUID != "" {
+		id, found := db.IDs[c.OptionUUID]
+		if !found && reason == "" {
+			reason = RemovedOptionNotVisible
+		}
+		c.OptionID = id
+	} else {
+		c.OptionUUID = db.UUID(c.OptionID)
+	}
+	if reason != "" {
+		return
+	}
+
+	// Int IDs (and UUIDs of something else) can still be unknown
+	a, found := db.Attributes[c.AttributeID]
+	if !found {
+		return res, RemovedUnknownAttribute
+	}
+	if o, found := db.Options[c.OptionID]; !found || o.AttributeID != a.ID {
+		return res, RemovedOptionNotVisible
+	}
+
+	return
+}
+
+func (db *DB) newCondition(attributeID, optionID int) *AttributeCondition {
+	return &AttributeCondition{
+		AttributeID:   attributeID,
+		OptionID:      optionID,
+		AttributeUUID: db.UUID(attributeID),
+		OptionUUID:    db.UUID(optionID),
+	}
+}
+
+// Returns copies of the filters with both int attribute IDs and UUIDs set, or
+// ErrInvalidFilter if a filter refers to an unknown attribute.
+func (db *DB) resolveFilters(filters []*OptionFilter) (res []*OptionFilter, err error) {
+	for _, f := range filters {
+		if f == nil {
+			continue
+		}
+
+		c := *f
+		if c.AttributeUUID != "" {
+			id, found := db.IDs[c.AttributeUUID]
+			if !found {
+				return nil, fmt.Errorf("%w: unknown attribute %s", ErrInvalidFilter, c.AttributeUUID)
+			}
+			c.AttributeID = id
+		} else {
+			c.AttributeUUID = db.UUID(c.AttributeID)
+		}
+		if _, found := db.Attributes[c.AttributeID]; !found {
+			return nil, fmt.Errorf("%w: unknown attribute %s", ErrInvalidFilter, conditionRef(c.AttributeID, c.AttributeUUID))
+		}
+		res = append(res, &c)
+	}
+	return
+}
@@ -8,7 +8,9 @@ import (
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/anrid/attribute-filters/pkg/attribute"
@@ -33,31 +35,59 @@ type IndexArgs struct {
 	BatchSize    int
 	Max          int
 	ConvertIDs   map[string]int // UUID => int ID
+	Errors       importer.ErrorHandling
+	Workers      int                  // item files read in parallel
+	Consumers    int                  // bulk index requests sent in parallel
+	Unordered    bool                 // index items as soon as they're read, see importer.FromSourceArgs
+	Checkpoints  importer.Checkpoints // save a checkpoint after each batch indexed (optional)
+	Resume       bool                 // continue after the last checkpoint instead of recreating the index
 }
 
-func Index(a IndexArgs) {
+// Name of the checkpoint saved when indexing items of the given files.
+func CheckpointName(prefixFilter string) string {
+	return ItemsNoDescIndexName + ":" + prefixFilter
+}
+
+func Index(a IndexArgs) (*importer.Summary, error) {
 	fmt.Printf("Running indexer: max %d items ..\n", a.Max)
 
-	CreateIndex()
+	if a.Resume && a.Checkpoints == nil {
+		return &importer.Summary{}, fmt.Errorf("can't resume indexing without checkpoints")
+	}
+	if !a.Resume {
+		CreateIndex()
+	}
 
 	start := time.Now()
 
-	importer.FromGzippedCSVFiles(importer.FromGzippedCSVFilesArgs{
-		Dir:          a.Dir,
+	s, err := importer.FromSource(importer.FromSourceArgs{
+		Source:       importer.NewDirSource(a.Dir),
 		PrefixFilter: a.PrefixFilter,
 		Batcher: &item.ItemsBatch{
 			Size:         a.BatchSize,
 			ForEachBatch: BulkIndex,
 			ConvertIDs:   a.ConvertIDs,
+			Consumers:    a.Consumers,
 		},
 		MaxRecordsToRead: a.Max,
+		Errors:           a.Errors,
+		Workers:          a.Workers,
+		Unordered:        a.Unordered,
+		Checkpoints:      a.Checkpoints,
+		CheckpointName:   CheckpointName(a.PrefixFilter),
+		Resume:           a.Resume,
 	})
+	if err != nil {
+		return s, err
+	}
 
 	Refresh(ItemsNoDescIndexName)
 	stats := IndexStats(ItemsNoDescIndexName)
 
 	fmt.Printf("Index stats (after):\n%s\n", ToPrettyJSON(stats))
-	fmt.Printf("Finished indexing %d items in %s\n", stats.All.Primaries.Docs.Count, time.Since(start))
+	fmt.Printf("Finished indexing %d items in %s (skipped %d bad records)\n", stats.All.Primaries.Docs.Count, time.Since(start), s.Skipped)
+
+	return s, nil
 }
 
 type Conditions struct {
@@ -95,6 +125,11 @@ type QueryArgs struct {
 	Size             int
 	CategoryFacets   bool
 	AttributeFacets  bool
+	// Max number of attribute facets (attribute-option pairs) to return,
+	// defaults to 10
+	AttributeFacetsSize int
+	// Only return facets, no items
+	OnlyFacets bool
 }
 
 var (
@@ -105,6 +140,9 @@ func Query(a QueryArgs) (*QueryResult, error) {
 	if a.Size == 0 {
 		a.Size = 10
 	}
+	if a.OnlyFacets {
+		a.Size = 0
+	}
 
 	createdSort := Map{"created": "desc"}
 	scoreSort := Map{"_score": "desc"}
@@ -119,6 +157,20 @@ func Query(a QueryArgs) (*QueryResult, error) {
 	if len(a.C.Statuses) > 0 {
 		filterTerms = append(filterTerms, Map{"terms": Map{"status": a.C.Statuses}})
 	}
+	if len(a.C.Attributes) > 0 {
+		// Items must have one of the selected options of each attribute
+		pairs := make(map[int][]string) // key = attribute ID
+		var attributeIDs []int
+		for _, ac := range a.C.Attributes {
+			if _, found := pairs[ac.AttributeID]; !found {
+				attributeIDs = append(attributeIDs, ac.AttributeID)
+			}
+			pairs[ac.AttributeID] = append(pairs[ac.AttributeID], fmt.Sprintf("%d-%d", ac.AttributeID, ac.OptionID))
+		}
+		for _, attributeID := range attributeIDs {
+			filterTerms = append(filterTerms, Map{"terms": Map{"attributes": pairs[attributeID]}})
+		}
+	}
 	if len(filterTerms) > 0 {
 		boolQuery["filter"] = filterTerms
 		sort = &createdSort
@@ -149,7 +201,11 @@ func Query(a QueryArgs) (*QueryResult, error) {
 		aggs["category_facets"] = Map{"terms": Map{"field": "category_id"}}
 	}
 	if a.AttributeFacets {
-		aggs["attribute_facets"] = Map{"terms": Map{"field": "attributes"}}
+		terms := Map{"field": "attributes"}
+		if a.AttributeFacetsSize > 0 {
+			terms["size"] = a.AttributeFacetsSize
+		}
+		aggs["attribute_facets"] = Map{"terms": terms}
 	}
 	if len(aggs) > 0 {
 		esQuery["aggs"] = aggs
@@ -241,6 +297,110 @@ func Query(a QueryArgs) (*QueryResult, error) {
 	return qr, nil
 }
 
+// OptionCounter counts items per option using a facet per attribute, see
+// attribute.OptionCounter. The options of each attribute are counted for items
+// matching the selections of all other attributes, so that other options of a
+// multi-select attribute keep their counts once one is selected.
+type OptionCounter struct {
+	Statuses []item.Status // only count items with these statuses, e.g. on sale
+}
+
+func (c *OptionCounter) CountOptions(a *attribute.CountOptionsArgs) (map[int]int, error) {
+	counts := make(map[int]int) // key = option ID
+	if len(a.AttributeIDs) == 0 {
+		return counts, nil
+	}
+
+	filterTerms := []Map{}
+	if len(a.CategoryIDs) > 0 {
+		filterTerms = append(filterTerms, Map{"terms": Map{"category_id": a.CategoryIDs}})
+	}
+	if len(c.Statuses) > 0 {
+		filterTerms = append(filterTerms, Map{"terms": Map{"status": c.Statuses}})
+	}
+
+	pairs := make(map[int][]string) // key = attribute ID, value = selected attribute-option pairs
+	for _, ac := range a.Selected {
+		pairs[ac.AttributeID] = append(pairs[ac.AttributeID], fmt.Sprintf("%d-%d", ac.AttributeID, ac.OptionID))
+	}
+
+	aggs := Map{}
+	for _, attributeID := range a.AttributeIDs {
+		// Items must have one of the selected options of each other attribute
+		others := []Map{}
+		for otherID, selected := range pairs {
+			if otherID != attributeID {
+				others = append(others, Map{"terms": Map{"attributes": selected}})
+			}
+		}
+
+		size := 1
+		if at, found := a.DB.Attributes[attributeID]; found && len(at.OptionIDs) > size {
+			// Count all options, not only the top ones
+			size = len(at.OptionIDs)
+		}
+
+		aggs[strconv.Itoa(attributeID)] = Map{
+			"filter": Map{"bool": Map{"filter": others}},
+			"aggs": Map{
+				"options": Map{"terms": Map{
+					"field":   "attributes",
+					"include": fmt.Sprintf("%d-[0-9]+", attributeID),
+					"size":    size,
+				}},
+			},
+		}
+	}
+
+	esQuery := Map{
+		"query": Map{"bool": Map{"filter": filterTerms}},
+		"size":  0,
+		"aggs":  aggs,
+	}
+
+	if DebugPrint {
+		fmt.Printf("Count query:\n%s\n", ToPrettyJSON(esQuery))
+	}
+
+	res, code, err := Call(http.MethodPost, Host+"/"+ItemsNoDescIndexName+"/_search", ToJSON(esQuery))
+	if err != nil {
+		return nil, err
+	}
+	if code >= 300 {
+		return nil, fmt.Errorf("got unexpected status code %d : %s", code, res)
+	}
+
+	cr := new(struct {
+		Aggs map[string]struct {
+			Options *Aggs `json:"options"`
+		} `json:"aggregations"`
+	})
+	err = sonic.Unmarshal(res, cr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range cr.Aggs {
+		if f.Options == nil {
+			continue
+		}
+		for _, b := range f.Options.Buckets {
+			pair, _ := b.Key.(string)
+			_, option, found := strings.Cut(pair, "-")
+			if !found {
+				continue
+			}
+			optionID, err := strconv.Atoi(option)
+			if err != nil {
+				continue
+			}
+			counts[optionID] += b.DocCount
+		}
+	}
+
+	return counts, nil
+}
+
 type SearchResult struct {
 	Took int64 `json:"took"` // 2
 
@@ -299,7 +459,48 @@ func BulkIndex(itemsTotal int, items []*item.Item) error {
 		return fmt.Errorf("bulk index: got status code %d", code)
 	}
 
-	return nil
+	// ES replies 200 OK even if some items failed
+	return bulkErrors(res)
+}
+
+type BulkResult struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// Returns an error describing the first item that failed, if any.
+func bulkErrors(res []byte) error {
+	br := new(BulkResult)
+	err := sonic.Unmarshal(res, br)
+	if err != nil {
+		return fmt.Errorf("bulk index: could not decode response: %w", err)
+	}
+	if !br.Errors {
+		return nil
+	}
+
+	var failed int
+	var first string
+	for _, i := range br.Items {
+		for _, r := range i {
+			if r.Error == nil {
+				continue
+			}
+			failed++
+			if first == "" {
+				first = fmt.Sprintf("item %s: %s (status %d): %s", r.ID, r.Error.Type, r.Status, r.Error.Reason)
+			}
+		}
+	}
+
+	return fmt.Errorf("bulk index: %d of %d items failed, first %s", failed, len(br.Items), first)
 }
 
 func CreateIndex() {
@@ -449,16 +650,20 @@ func Call(method, url string, body []byte) (respBody []byte, statusCode int, err
 	return
 }
 
-var _t *tokenizer.Tokenizer
+var (
+	_t     *tokenizer.Tokenizer
+	_tOnce sync.Once
+)
 
+// Safe for concurrent use, e.g. by parallel bulk index requests.
 func KagomeV2Tokenizer() *tokenizer.Tokenizer {
-	if _t == nil {
+	_tOnce.Do(func() {
 		var err error
 		_t, err = tokenizer.New(ipa.Dict(), tokenizer.OmitBosEos())
 		if err != nil {
 			log.Panic(err)
 		}
-	}
+	})
 	return _t
 }
 
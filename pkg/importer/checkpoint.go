@@ -0,0 +1,157 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrCheckpointMismatch = errors.New("checkpoint does not match source")
+
+// Checkpoint is the position in a source up to which records have been
+// processed, e.g. indexed, so that a failed import can be resumed from there.
+type Checkpoint struct {
+	File    string    `json:"file"`    // empty = nothing processed yet
+	Record  int       `json:"record"`  // last record processed in the file, headers are record 1
+	Batch   int       `json:"batch"`   // last batch processed, counting from 1
+	Records int       `json:"records"` // records read up to here, over all runs
+	Saved   time.Time `json:"saved"`
+}
+
+// Checkpoints persist checkpoints by name, e.g. store.Store. Loading a
+// checkpoint that was never saved returns nil.
+type Checkpoints interface {
+	LoadCheckpoint(name string) (*Checkpoint, error)
+	SaveCheckpoint(name string, c *Checkpoint) error
+}
+
+// BatchCounter is implemented by batchers that process records in batches
+// after they're added, e.g. asynchronously. Checkpoints are then only saved
+// for batches processed.
+type BatchCounter interface {
+	BatchesSent() int // batches sent to be processed
+	BatchesDone() int // batches processed successfully, with all batches sent before them
+}
+
+// Keeps track of the records added and saves checkpoints along the way.
+type tracker struct {
+	checkpoints Checkpoints
+	name        string
+	counter     BatchCounter // nil = records are done once added
+
+	from    Checkpoint         // where this run started
+	last    Checkpoint         // last record added
+	saved   Checkpoint         // last checkpoint saved
+	pending map[int]Checkpoint // key = batch number, value = position of the last record in the batch
+	sent    int
+}
+
+// Returns a tracker for the import and the files left to read. Resuming
+// continues after the last checkpoint saved, otherwise the checkpoint is reset.
+func (a FromSourceArgs) tracker(files []string) (*tracker, []string, error) {
+	if a.Checkpoints == nil {
+		return nil, files, nil
+	}
+	if a.Unordered {
+		return nil, nil, fmt.Errorf("checkpoints need records to be added in order, can't be used with unordered imports")
+	}
+
+	t := &tracker{
+		checkpoints: a.Checkpoints,
+		name:        a.CheckpointName,
+		pending:     make(map[int]Checkpoint),
+	}
+	if counter, ok := a.Batcher.(BatchCounter); ok {
+		t.counter = counter
+	}
+
+	if !a.Resume {
+		return t, files, t.save(Checkpoint{})
+	}
+
+	from, err := a.Checkpoints.LoadCheckpoint(a.CheckpointName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if from == nil || from.File == "" {
+		fmt.Printf("No checkpoint found for %s, starting from the beginning\n", a.CheckpointName)
+		return t, files, nil
+	}
+
+	for i, name := range files {
+		if name == from.File {
+			fmt.Printf("Resuming %s after %s record %d (batch %d, %d records read)\n",
+				a.CheckpointName, from.File, from.Record, from.Batch, from.Records)
+			t.from, t.last, t.saved = *from, *from, *from
+			return t, files[i:], nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%w: %s: file %s not found", ErrCheckpointMismatch, a.CheckpointName, from.File)
+}
+
+// Returns true if the record was processed in an earlier run.
+func (t *tracker) processed(file string, num int) bool {
+	return t != nil && file == t.from.File && num <= t.from.Record
+}
+
+// Records the position of a record just added.
+func (t *tracker) added(file string, num, records int) {
+	if t == nil {
+		return
+	}
+	t.last.File = file
+	t.last.Record = num
+	t.last.Records = t.from.Records + records
+	t.batchesSent()
+}
+
+func (t *tracker) batchesSent() {
+	if t.counter == nil {
+		return
+	}
+	if sent := t.counter.BatchesSent(); sent > t.sent {
+		t.pending[sent] = t.last
+		t.sent = sent
+	}
+}
+
+// Saves a checkpoint for the records processed so far, if any new.
+func (t *tracker) checkpoint() error {
+	if t == nil {
+		return nil
+	}
+
+	if t.counter == nil {
+		if t.last.File == t.saved.File && t.last.Record == t.saved.Record {
+			return nil
+		}
+		return t.save(t.last)
+	}
+
+	t.batchesSent()
+
+	done := t.counter.BatchesDone()
+	c, found := t.pending[done]
+	if !found {
+		return nil
+	}
+	for n := range t.pending {
+		if n <= done {
+			delete(t.pending, n)
+		}
+	}
+	c.Batch = t.from.Batch + done
+
+	return t.save(c)
+}
+
+func (t *tracker) save(c Checkpoint) error {
+	c.Saved = time.Now()
+	err := t.checkpoints.SaveCheckpoint(t.name, &c)
+	if err != nil {
+		return fmt.Errorf("save checkpoint %s: %w", t.name, err)
+	}
+	t.saved = c
+	return nil
+}
@@ -0,0 +1,166 @@
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMalformedRecord = errors.New("malformed record")
+	ErrTooManyErrors   = errors.New("too many errors")
+	ErrBatchFailed     = errors.New("batch failed") // batchers wrap errors processing batches with this
+)
+
+// ErrorPolicy decides what to do with records that can't be read or added.
+// Errors opening or reading files, schema drift and batch errors always stop
+// the import.
+type ErrorPolicy string
+
+const (
+	// Stop at the first bad record (default)
+	FailFast ErrorPolicy = "fail_fast"
+	// Skip bad records and list them in the summary
+	SkipAndCollect ErrorPolicy = "skip"
+	// Skip bad records and write them to a dead letter CSV file, see
+	// DeadLetterWriter
+	DeadLetter ErrorPolicy = "dead_letter"
+)
+
+// Keep at most this many errors in a summary
+const MaxErrorsInSummary = 100
+
+type ErrorHandling struct {
+	Policy     ErrorPolicy
+	MaxErrors  int               // stop with ErrTooManyErrors when more records are bad, 0 = no limit
+	DeadLetter *DeadLetterWriter // required by the dead letter policy
+}
+
+// Summary tells how an import went.
+type Summary struct {
+	Files    int            `json:"files"`
+	Records  int            `json:"records"` // records read, including skipped ones
+	Added    int            `json:"added"`   // records added
+	Skipped  int            `json:"skipped"` // bad records skipped, see ErrorPolicy
+	Errors   []*RecordError `json:"errors"`  // the first MaxErrorsInSummary errors of skipped records
+	Tables   map[string]int `json:"tables"`  // records read per table, see TableName
+	Duration time.Duration  `json:"duration"`
+}
+
+// Add adds the counts and errors of another summary, e.g. of another table.
+func (s *Summary) Add(o *Summary) {
+	s.Files += o.Files
+	s.Records += o.Records
+	s.Added += o.Added
+	s.Skipped += o.Skipped
+	s.Duration += o.Duration
+	for t, n := range o.Tables {
+		if s.Tables == nil {
+			s.Tables = make(map[string]int)
+		}
+		s.Tables[t] += n
+	}
+	for _, e := range o.Errors {
+		if len(s.Errors) >= MaxErrorsInSummary {
+			break
+		}
+		s.Errors = append(s.Errors, e)
+	}
+}
+
+// RecordError is an error reading or adding a record.
+type RecordError struct {
+	File   string   `json:"file"`
+	Record int      `json:"record"` // record number in the file, headers are record 1
+	Fields []string `json:"fields,omitempty"`
+	Err    error    `json:"-"`
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%s record %d: %s", e.File, e.Record, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// DeadLetterWriter writes rejected records to a CSV file with the columns
+// file, record and error, followed by the fields of the record. Records of
+// different tables can have different numbers of fields. Safe for concurrent
+// use.
+type DeadLetterWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+func NewDeadLetterFile(file string) (*DeadLetterWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+
+	dl := &DeadLetterWriter{f: f, w: csv.NewWriter(f)}
+
+	err = dl.w.Write([]string{"file", "record", "error", "fields"})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return dl, nil
+}
+
+func (dl *DeadLetterWriter) Write(e *RecordError) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	return dl.w.Write(append([]string{e.File, strconv.Itoa(e.Record), e.Err.Error()}, e.Fields...))
+}
+
+func (dl *DeadLetterWriter) Close() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	dl.w.Flush()
+	if err := dl.w.Error(); err != nil {
+		dl.f.Close()
+		return err
+	}
+	return dl.f.Close()
+}
+
+// Decides whether to skip a bad record or stop, see ErrorPolicy.
+func (h ErrorHandling) skip(s *Summary, e *RecordError) error {
+	switch h.Policy {
+	case "", FailFast:
+		return e
+	case SkipAndCollect:
+	case DeadLetter:
+		if h.DeadLetter == nil {
+			return fmt.Errorf("%w (dead letter policy without a dead letter file)", e)
+		}
+		if err := h.DeadLetter.Write(e); err != nil {
+			return fmt.Errorf("dead letter: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown error policy %s: %w", h.Policy, e)
+	}
+
+	s.Skipped++
+	if len(s.Errors) < MaxErrorsInSummary {
+		s.Errors = append(s.Errors, e)
+	}
+	if DebugPrint {
+		fmt.Printf("WARN: skipping %s\n", e)
+	}
+
+	if h.MaxErrors > 0 && s.Skipped > h.MaxErrors {
+		return fmt.Errorf("%w: skipped %d records, last: %w", ErrTooManyErrors, s.Skipped, e)
+	}
+	return nil
+}
@@ -1,14 +1,11 @@
 package importer
 
 import (
-	"compress/gzip"
-	"encoding/csv"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"os"
-	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 var (
@@ -22,110 +19,224 @@ type Batcher interface {
 	Flush() error
 }
 
-type FromGzippedCSVFilesArgs struct {
-	Dir              string  // Dir to look for files in
-	PrefixFilter     string  // limit to filenames matching the filter
-	MaxRecordsToRead int     // Max CSV records to read before exiting
-	Batcher          Batcher // Use this batcher (optional)
-	AddFunc          AddFunc // Call this add function for each record (optional)
+type FromSourceArgs struct {
+	Source           Source             // Read files from this source
+	Tables           []string           // limit to files of these tables, read in this order, see TableName (optional)
+	PrefixFilter     string             // limit to filenames matching the filter (optional)
+	MaxRecordsToRead int                // Max records to read before exiting
+	Batcher          Batcher            // Use this batcher (optional)
+	AddFunc          AddFunc            // Call this add function for each record (optional)
+	AddFuncs         map[string]AddFunc // Call these add functions for records of each table instead (optional)
+	Errors           ErrorHandling      // What to do with bad records, fail fast by default
+
+	// Number of files read and decoded in parallel, defaults to 1. Records
+	// are still added one at a time.
+	Workers int
+	// Add records as soon as they're read instead of file by file, in order.
+	// Only makes sense with more than one worker.
+	Unordered bool
+
+	// Save checkpoints of the records processed under this name (optional).
+	// With a BatchCounter batcher only records of processed batches count.
+	Checkpoints    Checkpoints
+	CheckpointName string
+	// Skip the records processed up to the last checkpoint saved
+	Resume bool
 }
 
-func FromGzippedCSVFiles(a FromGzippedCSVFilesArgs) {
-	dir, err := os.ReadDir(a.Dir)
+// FromSource reads the records of all matching files in the source, passing
+// them to the batcher or add functions. Files are read by a pool of workers
+// (see FromSourceArgs.Workers) and, unless unordered, added file by file in
+// order. Bad records are handled as set in Errors. Checkpoints are saved after
+// each chunk of records read, see FromSourceArgs.Checkpoints. Returns a summary
+// of the import, also when returning an error.
+func FromSource(a FromSourceArgs) (*Summary, error) {
+	start := time.Now()
+	s := &Summary{Tables: make(map[string]int)}
+	defer func() { s.Duration = time.Since(start) }()
+
+	if a.Batcher == nil && a.AddFunc == nil && len(a.AddFuncs) == 0 {
+		return s, fmt.Errorf("missing both batcher and add function")
+	}
+
+	files, err := a.files()
 	if err != nil {
-		log.Panic(err)
+		return s, err
 	}
 
-	var total int
+	t, files, err := a.tracker(files)
+	if err != nil {
+		return s, err
+	}
 
-	for _, fi := range dir {
-		if !strings.HasPrefix(fi.Name(), a.PrefixFilter) {
-			continue
-		}
+	p := newPipeline(a.Source, files, a.Workers, !a.Unordered)
 
-		fmt.Printf("Reading CSV records from file: %s\n", fi.Name())
+	seen := make(map[string]bool) // key = file name
+	var exitEarly bool
+	p.each(func(c *chunk) bool {
+		if !seen[c.file] {
+			seen[c.file] = true
+			s.Files++
+			fmt.Printf("Reading records from file: %s\n", c.file)
+		}
 
-		filename := filepath.Join(a.Dir, fi.Name())
-		f, err := os.Open(filename)
+		err = a.addChunk(c, s, t)
+		if err == nil {
+			err = t.checkpoint()
+		}
 		if err != nil {
-			log.Panic(err)
+			err = fmt.Errorf("%s: %w", c.file, err)
+			return false
 		}
+		exitEarly = a.MaxRecordsToRead > 0 && s.Records >= a.MaxRecordsToRead
+		return !exitEarly
+	})
+	p.close()
 
-		gr, err := gzip.NewReader(f)
+	if err != nil {
+		// Keep what's been processed, e.g. batches finished in the meantime
+		if cerr := t.checkpoint(); cerr != nil {
+			fmt.Printf("WARN: %s\n", cerr)
+		}
+		return s, err
+	}
+
+	if a.Batcher != nil {
+		err = a.Batcher.Flush()
+		if cerr := t.checkpoint(); cerr != nil && err == nil {
+			err = cerr
+		}
 		if err != nil {
-			log.Panic(err)
+			return s, err
 		}
+	}
 
-		cr := csv.NewReader(gr)
-		var records int
-		var exitEarly bool
-		var headers []string
+	fmt.Printf("Read %d records total\n", s.Records)
+	if s.Skipped > 0 {
+		fmt.Printf("WARN: skipped %d bad records\n", s.Skipped)
+	}
 
-		for {
-			rec, err := cr.Read()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Panic(err)
-			}
+	return s, nil
+}
+
+// Returns the files to read, ordered by table.
+func (a FromSourceArgs) files() ([]string, error) {
+	all, err := a.Source.Files()
+	if err != nil {
+		return nil, err
+	}
 
-			records++
+	order := make(map[string]int) // key = table name
+	for i, t := range a.Tables {
+		order[t] = i
+	}
 
-			if records == 1 {
-				headers = rec
-				continue
-			}
-			if DebugPrint {
-				if records == 2 {
-					// First record
-					for i, value := range rec {
-						fmt.Printf(" - %02d  %-40s  : %-30s\n", i, headers[i], value)
-					}
-				}
-			}
+	var files []string
+	for _, name := range all {
+		if !strings.HasPrefix(name, a.PrefixFilter) {
+			continue
+		}
+		if _, found := order[TableName(name)]; len(a.Tables) > 0 && !found {
+			continue
+		}
+		files = append(files, name)
+	}
 
-			total++
+	sort.SliceStable(files, func(i, j int) bool {
+		return order[TableName(files[i])] < order[TableName(files[j])]
+	})
 
-			if a.Batcher != nil {
-				err = a.Batcher.Add(rec, headers)
-				if err != nil {
-					log.Panic(err)
-				}
-			} else if a.AddFunc != nil {
-				err = a.AddFunc(rec, headers)
-				if err != nil {
-					log.Panic(err)
-				}
-			} else {
-				log.Panicf("missing both batcher and add function")
-			}
+	return files, nil
+}
+
+func (a FromSourceArgs) addFunc(file string) AddFunc {
+	if add, found := a.AddFuncs[TableName(file)]; found {
+		return add
+	}
+	if a.Batcher != nil {
+		return a.Batcher.Add
+	}
+	return a.AddFunc
+}
+
+func (a FromSourceArgs) addChunk(c *chunk, s *Summary, t *tracker) error {
+	add := a.addFunc(c.file)
+	if add == nil {
+		return fmt.Errorf("missing add function for table %s", TableName(c.file))
+	}
+
+	for _, r := range c.records {
+		if t.processed(c.file, r.num) {
+			continue
+		}
 
-			if DebugPrint {
-				if total%100_000 == 0 {
-					fmt.Printf("Read %d records ..\n", total)
+		err := r.err
+		if err == nil {
+			if DebugPrint && r.num == 2 {
+				// First record
+				for i, value := range r.fields {
+					if i < len(c.headers) {
+						fmt.Printf(" - %02d  %-40s  : %-30s\n", i, c.headers[i], value)
+					}
 				}
 			}
 
-			if a.MaxRecordsToRead > 0 && total >= a.MaxRecordsToRead {
-				exitEarly = true
-				break
+			err = add(r.fields, c.headers)
+			if errors.Is(err, ErrSchemaDrift) || errors.Is(err, ErrBatchFailed) {
+				// Every record of the file would fail, or it's not the
+				// record's fault
+				return err
 			}
 		}
 
-		if a.Batcher != nil {
-			err = a.Batcher.Flush()
+		s.Records++
+		s.Tables[TableName(c.file)]++
+
+		if err != nil {
+			err = a.Errors.skip(s, &RecordError{File: c.file, Record: r.num, Fields: r.fields, Err: err})
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
+		} else {
+			s.Added++
 		}
+		t.added(c.file, r.num, s.Records)
 
-		f.Close()
+		if DebugPrint {
+			if s.Records%100_000 == 0 {
+				fmt.Printf("Read %d records ..\n", s.Records)
+			}
+		}
 
-		if exitEarly {
-			break
+		if a.MaxRecordsToRead > 0 && s.Records >= a.MaxRecordsToRead {
+			return nil
 		}
 	}
 
-	fmt.Printf("Read %d records total\n", total)
+	return c.err
+}
+
+type FromGzippedCSVFilesArgs struct {
+	Dir              string        // Dir to look for files in
+	PrefixFilter     string        // limit to filenames matching the filter
+	MaxRecordsToRead int           // Max CSV records to read before exiting
+	Batcher          Batcher       // Use this batcher (optional)
+	AddFunc          AddFunc       // Call this add function for each record (optional)
+	Errors           ErrorHandling // What to do with bad records, fail fast by default
+	Workers          int           // Number of files read in parallel, see FromSourceArgs
+	Unordered        bool          // Add records as soon as they're read, see FromSourceArgs
+}
+
+// FromGzippedCSVFiles reads gzipped CSV files in a dir, see FromSource.
+func FromGzippedCSVFiles(a FromGzippedCSVFilesArgs) (*Summary, error) {
+	return FromSource(FromSourceArgs{
+		Source:           NewDirSource(a.Dir),
+		PrefixFilter:     a.PrefixFilter,
+		MaxRecordsToRead: a.MaxRecordsToRead,
+		Batcher:          a.Batcher,
+		AddFunc:          a.AddFunc,
+		Errors:           a.Errors,
+		Workers:          a.Workers,
+		Unordered:        a.Unordered,
+	})
 }
@@ -0,0 +1,427 @@
+package importer_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/anrid/attribute-filters/pkg/importer"
+	"github.com/anrid/attribute-filters/pkg/item"
+	"github.com/anrid/attribute-filters/pkg/store"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestImporter(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Importer Suite")
+}
+
+var _ = Describe("Importing records", Label("importer"), func() {
+	When("reading files", func() {
+		It("should detect formats from file contents", func() {
+			var gz bytes.Buffer
+			zw := gzip.NewWriter(&gz)
+			zw.Write([]byte("id,name\n1,シャネル\n"))
+			zw.Close()
+			Expect(readAll(&gz)).To(Equal([][]string{{"id", "name"}, {"1", "シャネル"}}))
+
+			Expect(readAll(strings.NewReader("\uFEFFid,name\n1,\"エルメス, パリ\"\n"))).To(Equal([][]string{{"id", "name"}, {"1", "エルメス, パリ"}}))
+
+			// Keys can come in any order, values are read the way Postgres
+			// exports them to CSV
+			Expect(readAll(strings.NewReader(
+				" \n" +
+					`{"id":1,"name":"シャネル","is_disabled":false,"color":null}` + "\n" +
+					`{"is_disabled":true,"name":"エルメス","id":2,"color":"#fff"}`,
+			))).To(Equal([][]string{
+				{"id", "name", "is_disabled", "color"},
+				{"1", "シャネル", "f", ""},
+				{"2", "エルメス", "t", "#fff"},
+			}))
+
+			_, err := importer.NewRecordReader(strings.NewReader(`[{"id":1}]`))
+			Expect(err).To(MatchError(importer.ErrUnknownFormat))
+
+			rr, err := importer.NewRecordReader(strings.NewReader("id,name\n1,\"シャネル\n"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = rr.Read()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = rr.Read()
+			Expect(err).To(MatchError(importer.ErrMalformedRecord))
+		})
+
+		It("should name tables after files", func() {
+			Expect(importer.TableName("export/attribute_option.csv.gz")).To(Equal("attribute_option"))
+			Expect(importer.TableName("items_0001.ndjson")).To(Equal("items_0001"))
+			Expect(importer.TableName("attribute.jsonl.gz")).To(Equal("attribute"))
+			Expect(importer.TableName("attribute.txt")).To(Equal("attribute.txt"))
+		})
+
+		It("should read files from a tar archive", func() {
+			file := filepath.Join(GinkgoT().TempDir(), "export.tar")
+			f, err := os.Create(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			tw := tar.NewWriter(f)
+			for _, name := range []string{"b.csv", "a.ndjson"} {
+				b := []byte("id\n1\n")
+				if name == "a.ndjson" {
+					b = []byte(`{"id":"1"}` + "\n")
+				}
+				Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(b))})).To(Succeed())
+				_, err = tw.Write(b)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(tw.Close()).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			src := &importer.TarSource{File: file}
+			files, err := src.Files()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(Equal([]string{"a.ndjson", "b.csv"}))
+
+			for _, name := range files {
+				rr, err := src.Open(name)
+				Expect(err).ToNot(HaveOccurred())
+				headers, err := rr.Read()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(headers).To(Equal([]string{"id"}))
+				Expect(rr.Close()).To(Succeed())
+			}
+
+			_, err = src.Open("missing.csv")
+			Expect(err).To(MatchError(importer.ErrFileNotFound))
+		})
+	})
+
+	When("mapping columns", func() {
+		schema := importer.NewSchema("items",
+			importer.Required("id", "item_id"),
+			importer.Required("name"),
+			importer.Optional("color"),
+		)
+
+		It("should look up fields by header name", func() {
+			r, err := schema.Record([]string{"シャネル", "1"}, []string{" Name", "\uFEFFITEM_ID"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Get("id")).To(Equal("1"))
+			Expect(r.Get("name")).To(Equal("シャネル"))
+			Expect(r.Has("color")).To(BeFalse())
+			Expect(r.Get("color")).To(BeEmpty())
+			Expect(func() { r.Get("price") }).To(Panic())
+
+			// Records without headers are in declared order
+			r, err = schema.Record([]string{"2", "エルメス", "#fff"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Get("name")).To(Equal("エルメス"))
+			Expect(r.Get("color")).To(Equal("#fff"))
+		})
+
+		It("should detect schema drift", func() {
+			_, err := schema.Map([]string{"id", "title"})
+			Expect(err).To(MatchError(importer.ErrSchemaDrift))
+			Expect(err.Error()).To(ContainSubstring("missing required columns name"))
+
+			_, err = schema.Map([]string{"id", "name", "Name"})
+			Expect(err).To(MatchError(importer.ErrSchemaDrift))
+			Expect(err.Error()).To(ContainSubstring("duplicate column name"))
+		})
+	})
+
+	When("records are bad", func() {
+		fsys := fstest.MapFS{
+			"numbers.csv": {Data: []byte("id,n\n" +
+				"1,1\n" +
+				"2,not-a-number\n" +
+				"3\n" +
+				"4,4\n")},
+		}
+		src := &importer.FSSource{FS: fsys}
+
+		var ids []string
+		add := func(rec, headers []string) error {
+			ids = append(ids, rec[0])
+			_, err := strconv.Atoi(rec[1])
+			return err
+		}
+
+		BeforeEach(func() {
+			ids = nil
+		})
+
+		It("should fail fast by default", func() {
+			s, err := importer.FromSource(importer.FromSourceArgs{Source: src, AddFunc: add})
+			Expect(err).To(MatchError(ContainSubstring("numbers.csv record 3")))
+			Expect(s.Added).To(Equal(1))
+		})
+
+		It("should skip bad records as set by the error policy", func() {
+			file := filepath.Join(GinkgoT().TempDir(), "rejects.csv")
+			dl, err := importer.NewDeadLetterFile(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			s, err := importer.FromSource(importer.FromSourceArgs{
+				Source:  src,
+				AddFunc: add,
+				Errors:  importer.ErrorHandling{Policy: importer.DeadLetter, DeadLetter: dl},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dl.Close()).To(Succeed())
+			Expect(ids).To(Equal([]string{"1", "2", "4"}))
+			Expect(s.Records).To(Equal(4))
+			Expect(s.Added).To(Equal(2))
+			Expect(s.Skipped).To(Equal(2))
+			Expect(s.Tables).To(Equal(map[string]int{"numbers": 4}))
+			Expect(s.Errors[0].Record).To(Equal(3))
+			Expect(s.Errors[1].Err).To(MatchError(importer.ErrMalformedRecord))
+
+			b, err := os.ReadFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Split(strings.TrimSpace(string(b)), "\n")).To(HaveLen(3))
+			Expect(string(b)).To(ContainSubstring("numbers.csv,4,"))
+
+			_, err = importer.FromSource(importer.FromSourceArgs{
+				Source:  src,
+				AddFunc: add,
+				Errors:  importer.ErrorHandling{Policy: importer.SkipAndCollect, MaxErrors: 1},
+			})
+			Expect(err).To(MatchError(importer.ErrTooManyErrors))
+
+			_, err = importer.FromSource(importer.FromSourceArgs{
+				Source:  src,
+				AddFunc: add,
+				Errors:  importer.ErrorHandling{Policy: importer.DeadLetter},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	When("reading files in parallel", func() {
+		It("should add records in order unless unordered", func() {
+			src, want := itemFiles(8, 2_500)
+
+			var got []string
+			add := func(rec, headers []string) error {
+				got = append(got, rec[0])
+				return nil
+			}
+
+			s, err := importer.FromSource(importer.FromSourceArgs{Source: src, AddFunc: add, Workers: 4})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Files).To(Equal(8))
+			Expect(got).To(Equal(want))
+
+			got = nil
+			_, err = importer.FromSource(importer.FromSourceArgs{Source: src, AddFunc: add, Workers: 4, Unordered: true})
+			Expect(err).ToNot(HaveOccurred())
+			sort.Strings(got)
+			Expect(got).To(Equal(want))
+
+			got = nil
+			s, err = importer.FromSource(importer.FromSourceArgs{Source: src, AddFunc: add, Workers: 4, MaxRecordsToRead: 3_000})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Records).To(Equal(3_000))
+			Expect(got).To(Equal(want[:3_000]))
+		})
+
+		It("should process batches on several consumers", func() {
+			src, want := itemFiles(8, 2_500)
+
+			var mu sync.Mutex
+			var indexed int
+			b := &item.ItemsBatch{
+				Size:      100,
+				Consumers: 3,
+				ForEachBatch: func(total int, items []*item.Item) error {
+					mu.Lock()
+					defer mu.Unlock()
+					indexed += len(items)
+					return nil
+				},
+			}
+			s, err := importer.FromSource(importer.FromSourceArgs{Source: src, Batcher: b, Workers: 4, Unordered: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Added).To(Equal(len(want)))
+			Expect(indexed).To(Equal(len(want)))
+			Expect(b.BatchesDone()).To(Equal(len(want) / 100))
+
+			// Failed batches always stop the import
+			b = &item.ItemsBatch{
+				Size:      100,
+				Consumers: 3,
+				ForEachBatch: func(total int, items []*item.Item) error {
+					return fmt.Errorf("bulk index: got status code 500")
+				},
+			}
+			_, err = importer.FromSource(importer.FromSourceArgs{Source: src, Batcher: b, Workers: 4, Errors: importer.ErrorHandling{Policy: importer.SkipAndCollect}})
+			Expect(err).To(MatchError(importer.ErrBatchFailed))
+		})
+	})
+
+	When("saving checkpoints", func() {
+		var st *store.Store
+
+		BeforeEach(func() {
+			st = store.New()
+			DeferCleanup(st.Connect(GinkgoT().TempDir()))
+		})
+
+		It("should resume imports from the last batch processed", func() {
+			src, want := itemFiles(3, 250)
+
+			var mu sync.Mutex
+			var indexed []string
+			index := func(total int, items []*item.Item) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if len(indexed) == 300 {
+					return fmt.Errorf("bulk index: got status code 429")
+				}
+				for _, i := range items {
+					indexed = append(indexed, i.ID)
+				}
+				return nil
+			}
+
+			args := importer.FromSourceArgs{
+				Source:         src,
+				Batcher:        &item.ItemsBatch{Size: 100, ForEachBatch: index},
+				Checkpoints:    st,
+				CheckpointName: "items",
+			}
+			_, err := importer.FromSource(args)
+			Expect(err).To(MatchError(importer.ErrBatchFailed))
+			Expect(indexed).To(Equal(want[:300]))
+
+			// Checkpoint is at the last record of the last batch indexed
+			c, err := st.LoadCheckpoint("items")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.File).To(Equal("items_1.csv"))
+			Expect(c.Record).To(Equal(51))
+			Expect(c.Batch).To(Equal(3))
+			Expect(c.Records).To(Equal(300))
+
+			args.Batcher = &item.ItemsBatch{Size: 100, Consumers: 3, ForEachBatch: func(total int, items []*item.Item) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, i := range items {
+					indexed = append(indexed, i.ID)
+				}
+				return nil
+			}}
+			args.Resume = true
+			s, err := importer.FromSource(args)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Records).To(Equal(450))
+			sort.Strings(indexed)
+			Expect(indexed).To(Equal(want))
+
+			c, err = st.LoadCheckpoint("items")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.File).To(Equal("items_2.csv"))
+			Expect(c.Record).To(Equal(251))
+			Expect(c.Batch).To(Equal(8))
+			Expect(c.Records).To(Equal(750))
+
+			// Checkpoints of other sources are rejected
+			delete(src.FS.(fstest.MapFS), "items_2.csv")
+			_, err = importer.FromSource(args)
+			Expect(err).To(MatchError(importer.ErrCheckpointMismatch))
+
+			// Starting over resets the checkpoint
+			args.Resume = false
+			args.MaxRecordsToRead = 50
+			args.Batcher = &item.ItemsBatch{Size: 10, ForEachBatch: func(total int, items []*item.Item) error { return nil }}
+			_, err = importer.FromSource(args)
+			Expect(err).ToNot(HaveOccurred())
+			c, err = st.LoadCheckpoint("items")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.File).To(Equal("items_0.csv"))
+			Expect(c.Record).To(Equal(51))
+			Expect(c.Batch).To(Equal(5))
+
+			args.Unordered = true
+			_, err = importer.FromSource(args)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should resume imports from the last record added without a batcher", func() {
+			src, want := itemFiles(1, 1_500)
+			fsys := src.FS.(fstest.MapFS)
+			fsys["items_0.csv"].Data = append(fsys["items_0.csv"].Data, []byte("bad,アイテム,on_sale,1700000000000,1700000000000,242,1000,1,\n")...)
+
+			var added []string
+			add := func(rec, headers []string) error {
+				if rec[0] == "bad" {
+					return fmt.Errorf("bad item")
+				}
+				added = append(added, rec[0])
+				return nil
+			}
+
+			args := importer.FromSourceArgs{Source: src, AddFunc: add, Checkpoints: st, CheckpointName: "items"}
+			_, err := importer.FromSource(args)
+			Expect(err).To(MatchError(ContainSubstring("bad item")))
+			Expect(added).To(Equal(want))
+
+			c, err := st.LoadCheckpoint("items")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.File).To(Equal("items_0.csv"))
+			Expect(c.Record).To(Equal(1_501))
+
+			// Only the bad record is read again
+			added = nil
+			args.Resume = true
+			args.Errors = importer.ErrorHandling{Policy: importer.SkipAndCollect}
+			s, err := importer.FromSource(args)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(added).To(BeEmpty())
+			Expect(s.Records).To(Equal(1))
+			Expect(s.Skipped).To(Equal(1))
+		})
+	})
+})
+
+func readAll(r io.Reader) (recs [][]string) {
+	rr, err := importer.NewRecordReader(r)
+	Expect(err).ToNot(HaveOccurred())
+	defer rr.Close()
+
+	for {
+		rec, err := rr.Read()
+		if err == io.EOF {
+			return
+		}
+		Expect(err).ToNot(HaveOccurred())
+		recs = append(recs, append([]string{}, rec...))
+	}
+}
+
+// Returns a source with files of items, and the IDs of all items in order.
+func itemFiles(files, items int) (*importer.FSSource, []string) {
+	fsys := fstest.MapFS{}
+	var ids []string
+	for f := 0; f < files; f++ {
+		var sb strings.Builder
+		sb.WriteString("id,name,status,created,updated,category_id,price,item_condition,attributes\n")
+		for n := 0; n < items; n++ {
+			id := fmt.Sprintf("m%d-%05d", f, n)
+			ids = append(ids, id)
+			fmt.Fprintf(&sb, "%s,アイテム,on_sale,1700000000000,1700000000000,242,1000,1,\n", id)
+		}
+		fsys[fmt.Sprintf("items_%d.csv", f)] = &fstest.MapFile{Data: []byte(sb.String())}
+	}
+	return &importer.FSSource{FS: fsys}, ids
+}
@@ -0,0 +1,195 @@
+package importer
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Records are passed from file readers to the add stage in chunks.
+const (
+	chunkSize   = 1_000
+	chunkBuffer = 4 // chunks buffered per reader before it blocks (backpressure)
+)
+
+type record struct {
+	fields []string
+	num    int   // record number in the file, headers are record 1
+	err    error // malformed record
+}
+
+type chunk struct {
+	file    string
+	headers []string
+	records []record
+	err     error // reading the file failed, always the last chunk of a file
+}
+
+// Reads files on a pool of workers, decoding records in parallel. In ordered
+// mode chunks are delivered file by file in the given order, otherwise as soon
+// as they're read. Readers block when the consumer falls behind.
+type pipeline struct {
+	source  Source
+	files   []string
+	workers int
+	ordered bool
+
+	done chan struct{} // closed to stop readers
+	wg   sync.WaitGroup
+
+	chans []chan *chunk // ordered mode, one per file
+	out   chan *chunk   // unordered mode
+}
+
+func newPipeline(source Source, files []string, workers int, ordered bool) *pipeline {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	p := &pipeline{
+		source:  source,
+		files:   files,
+		workers: workers,
+		ordered: ordered,
+		done:    make(chan struct{}),
+	}
+
+	if ordered {
+		p.chans = make([]chan *chunk, len(files))
+		for i := range p.chans {
+			p.chans[i] = make(chan *chunk, chunkBuffer)
+		}
+	} else {
+		p.out = make(chan *chunk, workers*chunkBuffer)
+	}
+
+	p.wg.Add(1)
+	go p.dispatch()
+
+	return p
+}
+
+// Starts a reader per file, at most workers at a time. Files are started in
+// order, so in ordered mode the file being consumed always has a reader.
+func (p *pipeline) dispatch() {
+	defer p.wg.Done()
+
+	sem := make(chan struct{}, p.workers)
+
+	var readers sync.WaitGroup
+	defer func() {
+		if !p.ordered {
+			readers.Wait()
+			close(p.out)
+		}
+	}()
+
+	for i, name := range p.files {
+		select {
+		case sem <- struct{}{}:
+		case <-p.done:
+			return
+		}
+
+		out := p.out
+		if p.ordered {
+			out = p.chans[i]
+		}
+
+		readers.Add(1)
+		p.wg.Add(1)
+		go func(name string, out chan *chunk) {
+			defer func() {
+				<-sem
+				readers.Done()
+				p.wg.Done()
+			}()
+			p.read(name, out)
+			if p.ordered {
+				close(out)
+			}
+		}(name, out)
+	}
+}
+
+func (p *pipeline) send(out chan *chunk, c *chunk) bool {
+	select {
+	case out <- c:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *pipeline) read(name string, out chan *chunk) {
+	rr, err := p.source.Open(name)
+	if err != nil {
+		p.send(out, &chunk{file: name, err: err})
+		return
+	}
+	defer rr.Close()
+
+	headers, err := rr.Read()
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		// Can't make sense of the rest without headers
+		p.send(out, &chunk{file: name, err: err})
+		return
+	}
+
+	c := &chunk{file: name, headers: headers}
+	num := 1
+
+	for {
+		rec, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !errors.Is(err, ErrMalformedRecord) {
+			c.err = err
+			break
+		}
+
+		num++
+		c.records = append(c.records, record{fields: rec, num: num, err: err})
+
+		if len(c.records) >= chunkSize {
+			if !p.send(out, c) {
+				return
+			}
+			c = &chunk{file: name, headers: headers}
+		}
+	}
+
+	if len(c.records) > 0 || c.err != nil {
+		p.send(out, c)
+	}
+}
+
+// Calls fn for each chunk until there are no more or fn returns false.
+func (p *pipeline) each(fn func(c *chunk) bool) {
+	if p.ordered {
+		for _, ch := range p.chans {
+			for c := range ch {
+				if !fn(c) {
+					return
+				}
+			}
+		}
+		return
+	}
+
+	for c := range p.out {
+		if !fn(c) {
+			return
+		}
+	}
+}
+
+// Stops all readers and waits for them to finish.
+func (p *pipeline) close() {
+	close(p.done)
+	p.wg.Wait()
+}
@@ -0,0 +1,152 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+var ErrSchemaDrift = errors.New("schema drift")
+
+// Column is a column of an exported table.
+type Column struct {
+	Name     string
+	Aliases  []string // other names the column is known by in older exports
+	Optional bool     // records can do without, e.g. columns added later on
+}
+
+func Required(name string, aliases ...string) Column {
+	return Column{Name: name, Aliases: aliases}
+}
+
+func Optional(name string, aliases ...string) Column {
+	return Column{Name: name, Aliases: aliases, Optional: true}
+}
+
+// Schema maps the columns of an exported table to record fields by header
+// name, so that reordering columns in an export doesn't silently corrupt the
+// data read. Columns are declared in export order, which is also used for
+// records without headers.
+type Schema struct {
+	Table   string
+	Columns []Column
+
+	last atomic.Pointer[Mapping] // mapping for the last headers seen
+}
+
+func NewSchema(table string, columns ...Column) *Schema {
+	return &Schema{Table: table, Columns: columns}
+}
+
+// Mapping tells where to find each column of a schema in records with the
+// given headers.
+type Mapping struct {
+	headers []string
+	index   map[string]int // key = column name, value = field index or -1 if missing
+}
+
+// Map returns the mapping for the headers, or ErrSchemaDrift if required
+// columns are missing or headers are duplicated. Without headers columns are
+// expected in declared order. Mappings are cached as long as headers stay the
+// same, e.g. for all records of a file.
+func (s *Schema) Map(headers []string) (*Mapping, error) {
+	if m := s.last.Load(); m != nil && sameHeaders(m.headers, headers) {
+		return m, nil
+	}
+
+	m := &Mapping{headers: headers, index: make(map[string]int, len(s.Columns))}
+
+	if headers == nil {
+		for i, c := range s.Columns {
+			m.index[c.Name] = i
+		}
+		s.last.Store(m)
+		return m, nil
+	}
+
+	positions := make(map[string]int, len(headers)) // key = normalized header
+	for i, h := range headers {
+		h = normalizeHeader(h)
+		if _, found := positions[h]; found {
+			return nil, fmt.Errorf("%w: %s: duplicate column %s", ErrSchemaDrift, s.Table, h)
+		}
+		positions[h] = i
+	}
+
+	var missing []string
+	for _, c := range s.Columns {
+		m.index[c.Name] = -1
+		for _, name := range append([]string{c.Name}, c.Aliases...) {
+			if i, found := positions[name]; found {
+				m.index[c.Name] = i
+				break
+			}
+		}
+		if m.index[c.Name] == -1 && !c.Optional {
+			missing = append(missing, c.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: %s: missing required columns %s (headers: %s)",
+			ErrSchemaDrift, s.Table, strings.Join(missing, ", "), strings.Join(headers, ", "))
+	}
+
+	s.last.Store(m)
+
+	return m, nil
+}
+
+// Record returns the record with fields looked up by column name, see Map.
+func (s *Schema) Record(rec, headers []string) (Record, error) {
+	m, err := s.Map(headers)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{m: m, rec: rec}, nil
+}
+
+// Record is a record of an exported table.
+type Record struct {
+	m   *Mapping
+	rec []string
+}
+
+// Get returns the value of a column, or an empty string if the column is
+// missing from the record. Panics if the column isn't in the schema.
+func (r Record) Get(column string) string {
+	i, found := r.m.index[column]
+	if !found {
+		panic(fmt.Sprintf("column %s is not in the schema", column))
+	}
+	if i < 0 || i >= len(r.rec) {
+		return ""
+	}
+	return r.rec[i]
+}
+
+// Has returns true if the record has the column.
+func (r Record) Has(column string) bool {
+	i, found := r.m.index[column]
+	return found && i >= 0 && i < len(r.rec)
+}
+
+func normalizeHeader(h string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\uFEFF")))
+}
+
+func sameHeaders(a, b []string) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	if len(a) > 0 && &a[0] == &b[0] {
+		// Same slice, e.g. records of the same file
+		return true
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
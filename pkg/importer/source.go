@@ -0,0 +1,366 @@
+package importer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown format")
+	ErrFileNotFound  = errors.New("file not found")
+)
+
+// Source provides exported tables as files, e.g. gzipped CSV files in a dir,
+// files in a tar archive or embedded test data. Each table can be split over
+// several files (e.g. items_0001.csv.gz, items_0002.csv.gz ..).
+type Source interface {
+	// Files returns the names of all files in the source, sorted by name
+	Files() ([]string, error)
+	// Open returns a reader for the records of a file, see NewRecordReader
+	Open(name string) (RecordReader, error)
+}
+
+// RecordReader reads records, one at a time, from a file. The first record
+// holds the headers (column names).
+type RecordReader interface {
+	Read() ([]string, error) // returns io.EOF after the last record
+	Close() error
+}
+
+// TableName returns the name of the table in a file by stripping format
+// extensions, e.g. attribute_option.csv.gz => attribute_option
+func TableName(file string) string {
+	name := path.Base(file)
+	for {
+		ext := path.Ext(name)
+		switch ext {
+		case ".gz", ".csv", ".ndjson", ".jsonl":
+			name = strings.TrimSuffix(name, ext)
+		default:
+			return name
+		}
+	}
+}
+
+// FSSource reads files from a file system, e.g. os.DirFS or an embed.FS.
+// Formats are detected from file contents, see NewRecordReader.
+type FSSource struct {
+	FS  fs.FS
+	Dir string // dir in the file system to read files from, defaults to "."
+}
+
+// NewDirSource returns a source reading files from a dir on disk.
+func NewDirSource(dir string) *FSSource {
+	return &FSSource{FS: os.DirFS(dir)}
+}
+
+func (s *FSSource) dir() string {
+	if s.Dir == "" {
+		return "."
+	}
+	return s.Dir
+}
+
+func (s *FSSource) Files() ([]string, error) {
+	entries, err := fs.ReadDir(s.FS, s.dir())
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		files = append(files, e.Name())
+	}
+	return files, nil
+}
+
+func (s *FSSource) Open(name string) (RecordReader, error) {
+	f, err := s.FS.Open(path.Join(s.dir(), name))
+	if err != nil {
+		return nil, err
+	}
+
+	rr, err := NewRecordReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return &recordReadCloser{RecordReader: rr, c: f}, nil
+}
+
+// TarSource reads files from a tar archive (optionally gzipped, e.g. .tar.gz).
+// Files are read straight from the archive, which is scanned once per file
+// opened.
+type TarSource struct {
+	File string
+}
+
+func (s *TarSource) Files() ([]string, error) {
+	f, tr, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var files []string
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg {
+			files = append(files, h.Name)
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func (s *TarSource) Open(name string) (RecordReader, error) {
+	f, tr, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			f.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("%w: %s in %s", ErrFileNotFound, name, s.File)
+			}
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg || h.Name != name {
+			continue
+		}
+
+		rr, err := NewRecordReader(tr)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return &recordReadCloser{RecordReader: rr, c: f}, nil
+	}
+}
+
+func (s *TarSource) open() (io.Closer, *tar.Reader, error) {
+	f, err := os.Open(s.File)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if isGzipped(br) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		r = gr
+	}
+
+	return f, tar.NewReader(r), nil
+}
+
+// NewRecordReader detects the format of the data and returns a reader for
+// its records. Supports CSV and NDJSON (one JSON object per line), both
+// optionally gzipped.
+func NewRecordReader(r io.Reader) (RecordReader, error) {
+	br := bufio.NewReader(r)
+
+	if isGzipped(br) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gr)
+	}
+
+	// Skip leading whitespace and a byte order mark, if any
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				// Empty
+				return &csvReader{cr: csv.NewReader(br)}, nil
+			}
+			return nil, err
+		}
+		if c == '\uFEFF' || c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		br.UnreadRune()
+
+		if c == '{' {
+			return newNDJSONReader(br), nil
+		}
+		if c == '[' {
+			return nil, fmt.Errorf("%w: JSON arrays are not supported, use NDJSON", ErrUnknownFormat)
+		}
+		return &csvReader{cr: csv.NewReader(br)}, nil
+	}
+}
+
+func isGzipped(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+type csvReader struct {
+	cr *csv.Reader
+}
+
+func (r *csvReader) Read() ([]string, error) {
+	rec, err := r.cr.Read()
+	if pe := (*csv.ParseError)(nil); errors.As(err, &pe) {
+		// The reader can carry on with the next record
+		return rec, fmt.Errorf("%w: %w", ErrMalformedRecord, err)
+	}
+	return rec, err
+}
+
+func (r *csvReader) Close() error {
+	return nil
+}
+
+// Reads NDJSON objects as records. Headers are the keys of the first object,
+// in order, and values of later objects are matched to headers by key.
+type ndjsonReader struct {
+	br      *bufio.Reader
+	headers []string
+	pending []string // the first record, read together with the headers
+	line    int
+}
+
+func newNDJSONReader(br *bufio.Reader) *ndjsonReader {
+	return &ndjsonReader{br: br}
+}
+
+func (r *ndjsonReader) Read() ([]string, error) {
+	if r.pending != nil {
+		rec := r.pending
+		r.pending = nil
+		return rec, nil
+	}
+
+	for {
+		line, err := r.br.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		r.line++
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		keys, values, err := decodeObject(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: ndjson line %d: %w", ErrMalformedRecord, r.line, err)
+		}
+
+		if r.headers == nil {
+			r.headers = keys
+			r.pending = values
+			return keys, nil
+		}
+
+		rec := make([]string, len(r.headers))
+		for i, k := range keys {
+			for j, h := range r.headers {
+				if h == k {
+					rec[j] = values[i]
+					break
+				}
+			}
+		}
+		return rec, nil
+	}
+}
+
+func (r *ndjsonReader) Close() error {
+	return nil
+}
+
+// Decodes a JSON object, keeping the order of its keys. Values are returned
+// as strings the way Postgres exports them to CSV: strings as is, null as an
+// empty string, booleans as t or f and everything else as JSON.
+func decodeObject(b []byte) (keys, values []string, err error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	t, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '{' {
+		return nil, nil, fmt.Errorf("%w: expected a JSON object", ErrUnknownFormat)
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := t.(string)
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, nil, err
+		}
+
+		var value string
+		switch {
+		case bytes.Equal(raw, []byte("null")):
+		case bytes.Equal(raw, []byte("true")):
+			value = "t"
+		case bytes.Equal(raw, []byte("false")):
+			value = "f"
+		case len(raw) > 0 && raw[0] == '"':
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, nil, err
+			}
+		default:
+			value = string(raw)
+		}
+
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+
+	return
+}
+
+type recordReadCloser struct {
+	RecordReader
+	c io.Closer
+}
+
+func (r *recordReadCloser) Close() error {
+	r.RecordReader.Close()
+	return r.c.Close()
+}
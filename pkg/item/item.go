@@ -3,9 +3,11 @@ package item
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/anrid/attribute-filters/pkg/importer"
 )
 
 type Status int
@@ -47,12 +49,43 @@ type ItemsBatch struct {
 	ForEachBatch func(totalItems int, items []*Item) error
 	ConvertIDs   map[string]int // key = UUID, value = int (attribute ID or option ID)
 	stats        map[string]map[string]int
+
+	// Number of batches processed at a time, defaults to 1. Adding items
+	// blocks while all consumers are busy.
+	Consumers int
+
+	batches chan *batch
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	err     error        // first error processing a batch
+	sent    int          // batches sent, numbered from 1
+	done    int          // batches processed, with all batches sent before them
+	ahead   map[int]bool // batches processed before earlier ones, key = batch number
+}
+
+type batch struct {
+	num   int
+	total int
+	items []*Item
 }
 
+// Columns of exported items, in export order.
+var itemSchema = importer.NewSchema("items",
+	importer.Required("id", "item_id"),
+	importer.Required("name"),
+	importer.Required("status"), // on_sale, trading, sold_out, stop or cancel
+	importer.Required("created", "created_at"),
+	importer.Required("updated", "updated_at"),
+	importer.Required("category_id"),
+	importer.Required("price"),
+	importer.Required("item_condition", "item_condition_id"), // 1 (like new) to 3 (poor)
+	importer.Required("attributes"),                          // attribute UUID=option UUID pairs separated by |
+)
+
 func (b *ItemsBatch) Add(rec, headers []string) error {
-	isItem := len(rec) == 9 && headers[2] == "status"
-	if !isItem {
-		return fmt.Errorf("does not look like an Item record: %+v", headers)
+	r, err := itemSchema.Record(rec, headers)
+	if err != nil {
+		return fmt.Errorf("does not look like an Item record: %w", err)
 	}
 
 	// Tally up some basic stats for this import
@@ -64,19 +97,19 @@ func (b *ItemsBatch) Add(rec, headers []string) error {
 		if _, found := b.stats["statuses"]; !found {
 			b.stats["statuses"] = make(map[string]int)
 		}
-		b.stats["statuses"][rec[2]]++
+		b.stats["statuses"][r.Get("status")]++
 
 		if _, found := b.stats["categories"]; !found {
 			b.stats["categories"] = make(map[string]int)
 		}
-		b.stats["categories"][rec[5]]++
+		b.stats["categories"][r.Get("category_id")]++
 	}
 
 	i := new(Item)
 
-	i.ID = rec[0]
-	i.Name = rec[1]
-	switch rec[2] {
+	i.ID = r.Get("id")
+	i.Name = r.Get("name")
+	switch r.Get("status") {
 	case "on_sale":
 		i.Status = StatusOnSale
 	case "trading":
@@ -90,11 +123,25 @@ func (b *ItemsBatch) Add(rec, headers []string) error {
 	default:
 		i.Status = StatusOther
 	}
-	i.Created = ToInt64(rec[3])
-	i.Updated = ToInt64(rec[4])
-	i.CategoryID = int(ToInt64(rec[5]))
-	i.Price = int(ToInt64(rec[6]))
-	switch rec[7] {
+	i.Created, err = parseInt64(r, "created")
+	if err != nil {
+		return err
+	}
+	i.Updated, err = parseInt64(r, "updated")
+	if err != nil {
+		return err
+	}
+	categoryID, err := parseInt64(r, "category_id")
+	if err != nil {
+		return err
+	}
+	i.CategoryID = int(categoryID)
+	price, err := parseInt64(r, "price")
+	if err != nil {
+		return err
+	}
+	i.Price = int(price)
+	switch r.Get("item_condition") {
 	case "1":
 		i.ItemCondition = ItemConditionLikeNew
 	case "2":
@@ -105,13 +152,13 @@ func (b *ItemsBatch) Add(rec, headers []string) error {
 		i.ItemCondition = ItemConditionOther
 	}
 
-	if len(rec[8]) > 1 {
+	if attributes := r.Get("attributes"); len(attributes) > 1 {
 		// This record contains item attribute-option pairs
-		aoPairs := strings.SplitN(rec[8], "|", -1)
+		aoPairs := strings.SplitN(attributes, "|", -1)
 		for _, aoPair := range aoPairs {
 			parts := strings.SplitN(aoPair, "=", 2)
 			if len(parts) != 2 {
-				log.Panicf("Failed to parse invalid attributes data: '%s'\n", rec[8])
+				return fmt.Errorf("item %s: invalid attributes data: '%s'", i.ID, attributes)
 			}
 
 			attributeUUID := parts[0]
@@ -119,13 +166,13 @@ func (b *ItemsBatch) Add(rec, headers []string) error {
 
 			attributeID, found := b.ConvertIDs[attributeUUID]
 			if !found {
-				// fmt.Printf("WARN: could not find attribute %s for item %s\nattributes data: %s\n", attributeUUID, ToPrettyJSON(i), rec[8])
+				// fmt.Printf("WARN: could not find attribute %s for item %s\nattributes data: %s\n", attributeUUID, ToPrettyJSON(i), attributes)
 				continue
 			}
 
 			optionID, found := b.ConvertIDs[optionUUID]
 			if !found {
-				// fmt.Printf("could not find option %s for item %s\nattributes data: %s\n", optionUUID, ToPrettyJSON(i), rec[8])
+				// fmt.Printf("could not find option %s for item %s\nattributes data: %s\n", optionUUID, ToPrettyJSON(i), attributes)
 				continue
 			}
 
@@ -147,22 +194,131 @@ func (b *ItemsBatch) Add(rec, headers []string) error {
 	b.Items = append(b.Items, i)
 
 	if len(b.Items) >= b.Size {
-		err := b.ForEachBatch(b.Total, b.Items)
+		err := b.send()
 		if err != nil {
 			return err
 		}
-		b.Items = nil
 	}
 	return nil
 }
 
+// Passes the current items to ForEachBatch, on a pool of consumers if there's
+// more than one.
+func (b *ItemsBatch) send() error {
+	items := b.Items
+	b.Items = nil
+
+	b.mu.Lock()
+	b.sent++
+	num := b.sent
+	b.mu.Unlock()
+
+	if b.Consumers <= 1 {
+		err := b.ForEachBatch(b.Total, items)
+		if err != nil {
+			return fmt.Errorf("%w: %w", importer.ErrBatchFailed, err)
+		}
+		b.batchDone(num)
+		return nil
+	}
+
+	if b.batches == nil {
+		b.batches = make(chan *batch, b.Consumers)
+		for c := 0; c < b.Consumers; c++ {
+			b.wg.Add(1)
+			go b.consume()
+		}
+	}
+
+	if err := b.firstError(); err != nil {
+		b.stop()
+		return err
+	}
+
+	b.batches <- &batch{num: num, total: b.Total, items: items}
+
+	return nil
+}
+
+func (b *ItemsBatch) consume() {
+	defer b.wg.Done()
+
+	for bt := range b.batches {
+		if b.firstError() != nil {
+			// Drain
+			continue
+		}
+		err := b.ForEachBatch(bt.total, bt.items)
+		if err != nil {
+			b.mu.Lock()
+			if b.err == nil {
+				b.err = fmt.Errorf("%w: %w", importer.ErrBatchFailed, err)
+			}
+			b.mu.Unlock()
+			continue
+		}
+		b.batchDone(bt.num)
+	}
+}
+
+// Batches can finish out of order with several consumers, only count those
+// with all batches before them done.
+func (b *ItemsBatch) batchDone(num int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.ahead == nil {
+		b.ahead = make(map[int]bool)
+	}
+	b.ahead[num] = true
+	for b.ahead[b.done+1] {
+		delete(b.ahead, b.done+1)
+		b.done++
+	}
+}
+
+// BatchesSent implements importer.BatchCounter.
+func (b *ItemsBatch) BatchesSent() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sent
+}
+
+// BatchesDone implements importer.BatchCounter.
+func (b *ItemsBatch) BatchesDone() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.done
+}
+
+// Waits for the consumers to finish, if any.
+func (b *ItemsBatch) stop() {
+	if b.batches != nil {
+		close(b.batches)
+		b.wg.Wait()
+		b.batches = nil
+	}
+}
+
+func (b *ItemsBatch) firstError() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// Flush processes the remaining items and waits for all batches to be
+// processed.
 func (b *ItemsBatch) Flush() error {
 	if len(b.Items) > 0 {
-		err := b.ForEachBatch(b.Total, b.Items)
+		err := b.send()
 		if err != nil {
 			return err
 		}
-		b.Items = nil
+	}
+
+	b.stop()
+	if err := b.firstError(); err != nil {
+		return err
 	}
 
 	fmt.Printf(
@@ -173,6 +329,14 @@ func (b *ItemsBatch) Flush() error {
 	return nil
 }
 
+func parseInt64(r importer.Record, column string) (int64, error) {
+	n, err := strconv.ParseInt(r.Get(column), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("item %s %s: %w", r.Get("id"), column, err)
+	}
+	return n, nil
+}
+
 func ToInt64(n string) int64 {
 	i, err := strconv.ParseInt(n, 10, 64)
 	if err != nil {
@@ -0,0 +1,89 @@
+package item
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestItems(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Items Suite")
+}
+
+var _ = Describe("Batching items", Label("items"), func() {
+	When("adding item records", func() {
+		It("should map columns by header name", func() {
+			var got []*Item
+			b := &ItemsBatch{
+				Size:       10,
+				ConvertIDs: map[string]int{"a-uuid": 1, "o-uuid": 11},
+				ForEachBatch: func(total int, items []*Item) error {
+					got = append(got, items...)
+					return nil
+				},
+			}
+
+			headers := []string{"item_id", "name", "status", "created_at", "updated_at", "category_id", "price", "item_condition_id", "attributes"}
+			Expect(b.Add([]string{"m1", "財布", "sold_out", "1700000000000", "1700000000001", "242", "1000", "2", "a-uuid=o-uuid|x=y"}, headers)).To(Succeed())
+			Expect(b.Flush()).To(Succeed())
+
+			Expect(got).To(Equal([]*Item{{
+				ID:            "m1",
+				Name:          "財布",
+				Status:        StatusSold,
+				Created:       1700000000000,
+				Updated:       1700000000001,
+				CategoryID:    242,
+				Price:         1000,
+				ItemCondition: ItemConditionGood,
+				Attributes:    []string{"1-11"},
+			}}))
+
+			err := b.Add([]string{"m2", "財布", "on_sale", "yesterday", "1700000000001", "242", "1000", "2", ""}, headers)
+			Expect(err).To(MatchError(ContainSubstring("item m2 created")))
+		})
+	})
+
+	When("processing batches on several consumers", func() {
+		It("should only count batches done with all batches before them", func() {
+			var mu sync.Mutex
+			release := make(chan struct{})
+			var processed []int
+
+			b := &ItemsBatch{
+				Size:      1,
+				Consumers: 2,
+				ForEachBatch: func(total int, items []*Item) error {
+					if total == 1 {
+						// The first batch finishes last
+						<-release
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					processed = append(processed, total)
+					return nil
+				},
+			}
+
+			for _, id := range []string{"m1", "m2"} {
+				Expect(b.Add([]string{id, "財布", "on_sale", "1700000000000", "1700000000000", "242", "1000", "1", ""}, nil)).To(Succeed())
+			}
+			Expect(b.BatchesSent()).To(Equal(2))
+
+			Eventually(func() []int {
+				mu.Lock()
+				defer mu.Unlock()
+				return processed
+			}).Should(Equal([]int{2}))
+			Consistently(b.BatchesDone, 50*time.Millisecond).Should(Equal(0))
+
+			close(release)
+			Expect(b.Flush()).To(Succeed())
+			Expect(b.BatchesDone()).To(Equal(2))
+		})
+	})
+})
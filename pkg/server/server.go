@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anrid/attribute-filters/pkg/attribute"
+)
+
+const (
+	// Search conditions are small, anything larger is likely a bad request
+	MaxRequestBodyBytes = 1 << 20 // 1 mb
+)
+
+type Server struct {
+	h *attribute.Holder
+
+	// Counts items per option when search conditions ask for counts,
+	// optional
+	Counter attribute.OptionCounter
+}
+
+func New(h *attribute.Holder) *Server {
+	return &Server{h: h}
+}
+
+// Handler returns the routes served by the API:
+//
+//	POST /v1/visible-attributes  - body: SearchConditions, returns FindVisibleAttributesResponse
+//	POST /v1/validate-listing    - body: ListingRequest, returns ListingValidation
+//	POST /v1/form-layout         - body: ListingRequest, returns FormLayout
+//	GET  /v1/version             - returns the version of the attributes DB currently served
+//	POST /v1/reload              - reloads the attributes DB in the background
+//	GET  /healthz                - returns 200 OK when the server is up
+//
+// Responses based on the attributes DB carry its version in the ETag and
+// X-Attributes-Version headers.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/visible-attributes", s.VisibleAttributes)
+	mux.HandleFunc("/v1/validate-listing", s.ValidateListing)
+	mux.HandleFunc("/v1/form-layout", s.FormLayout)
+	mux.HandleFunc("/v1/version", s.Version)
+	mux.HandleFunc("/v1/reload", s.Reload)
+	mux.HandleFunc("/healthz", s.Health)
+	return mux
+}
+
+func (s *Server) VisibleAttributes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	sc := new(attribute.SearchConditions)
+	if err := DecodeJSON(w, r, sc); err != nil {
+		WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid search conditions: %w", err))
+		return
+	}
+
+	// Stick to the same version of the DB for the whole request,
+	// even if a reload swaps in a new one meanwhile
+	v := s.h.Current()
+	setVersionHeaders(w, v)
+
+	res, err := attribute.FindVisibleAttributesWithCounts(sc, v.DB, s.Counter)
+	if err != nil {
+		WriteError(w, StatusCode(err), err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, res)
+}
+
+// ListingRequest is the category and selected options of a listing in the
+// sell form.
+type ListingRequest struct {
+	CategoryID int                             `json:"category_id"`
+	Attributes []*attribute.AttributeCondition `json:"attributes"`
+}
+
+func (s *Server) ValidateListing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	req := new(ListingRequest)
+	if err := DecodeJSON(w, r, req); err != nil {
+		WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid listing: %w", err))
+		return
+	}
+
+	v := s.h.Current()
+	setVersionHeaders(w, v)
+
+	res, err := v.DB.ValidateListing(req.CategoryID, req.Attributes)
+	if err != nil {
+		WriteError(w, StatusCode(err), err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) FormLayout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	req := new(ListingRequest)
+	if err := DecodeJSON(w, r, req); err != nil {
+		WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid listing: %w", err))
+		return
+	}
+
+	v := s.h.Current()
+	setVersionHeaders(w, v)
+
+	res, err := v.DB.FormLayout(req.CategoryID, req.Attributes)
+	if err != nil {
+		WriteError(w, StatusCode(err), err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, res)
+}
+
+type VersionResponse struct {
+	Version   int64     `json:"version"`
+	ETag      string    `json:"etag"`
+	LoadedAt  time.Time `json:"loaded_at"`
+	Reloading bool      `json:"reloading"`
+}
+
+func (s *Server) Version(w http.ResponseWriter, r *http.Request) {
+	v := s.h.Current()
+	setVersionHeaders(w, v)
+
+	WriteJSON(w, http.StatusOK, &VersionResponse{
+		Version:   v.Number,
+		ETag:      v.ETag,
+		LoadedAt:  v.LoadedAt,
+		Reloading: s.h.IsReloading(),
+	})
+}
+
+func (s *Server) Reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if s.h.IsReloading() {
+		WriteError(w, http.StatusConflict, attribute.ErrReloadInProgress)
+		return
+	}
+
+	s.h.ReloadInBackground(func(err error) {
+		if err != nil {
+			fmt.Printf("WARN: %s\n", err)
+		}
+	})
+
+	WriteJSON(w, http.StatusAccepted, map[string]string{"status": "reloading"})
+}
+
+func setVersionHeaders(w http.ResponseWriter, v *attribute.Version) {
+	w.Header().Set("ETag", v.ETag)
+	w.Header().Set("X-Attributes-Version", strconv.FormatInt(v.Number, 10))
+}
+
+func (s *Server) Health(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// DecodeJSON decodes a request body of at most MaxRequestBodyBytes,
+// rejecting unknown fields.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodyBytes))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// StatusCode maps errors caused by bad search conditions to 400 Bad Request
+// and everything else to 500 Internal Server Error.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, attribute.ErrUnknownCategory),
+		errors.Is(err, attribute.ErrInvalidCursor),
+		errors.Is(err, attribute.ErrInvalidFilter),
+		errors.Is(err, attribute.ErrInvalidSort),
+		errors.Is(err, attribute.ErrInvalidOffset),
+		errors.Is(err, attribute.ErrInvalidPageSize),
+		errors.Is(err, attribute.ErrNoOptionCounter):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func WriteError(w http.ResponseWriter, code int, err error) {
+	if code >= 500 {
+		fmt.Printf("ERROR: %s\n", err)
+	}
+	WriteJSON(w, code, &ErrorResponse{Error: err.Error()})
+}
+
+func WriteJSON(w http.ResponseWriter, code int, o interface{}) {
+	b, err := json.Marshal(o)
+	if err != nil {
+		code = http.StatusInternalServerError
+		b = []byte(`{"error":"could not encode response"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/anrid/attribute-filters/pkg/attribute"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Server Suite")
+}
+
+var h *attribute.Holder
+
+var _ = BeforeSuite(func() {
+	var err error
+	h, err = attribute.NewHolder(func() (*attribute.DB, error) {
+		db := attribute.NewDB()
+
+		err := db.LoadCategoriesJSON("../../../test-data/categories.json")
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.ImportPostgresDatabase(attribute.ImportPostgresDatabaseArgs{Dir: "../../../test-data"})
+		if err != nil {
+			return nil, err
+		}
+
+		db.PreSort()
+
+		return db, nil
+	})
+	Expect(err).ToNot(HaveOccurred())
+})
+
+var _ = Describe("Serving the attributes DB", Label("server"), func() {
+	// category 242 - レディース - 小物 - 折り財布
+	categoryID := 242
+
+	var handler http.Handler
+
+	BeforeEach(func() {
+		handler = New(h).Handler()
+	})
+
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	errorOf := func(w *httptest.ResponseRecorder) string {
+		res := new(ErrorResponse)
+		Expect(json.Unmarshal(w.Body.Bytes(), res)).To(Succeed())
+		return res.Error
+	}
+
+	It("should only accept POST requests where a body is expected", func() {
+		for _, path := range []string{"/v1/visible-attributes", "/v1/validate-listing", "/v1/form-layout", "/v1/reload"} {
+			w := call(http.MethodGet, path, "")
+			Expect(w.Code).To(Equal(http.StatusMethodNotAllowed), path)
+			Expect(w.Header().Get("Allow")).To(Equal(http.MethodPost))
+			Expect(errorOf(w)).To(ContainSubstring("method GET not allowed"))
+		}
+	})
+
+	It("should return visible attributes with the version of the DB", func() {
+		w := call(http.MethodPost, "/v1/visible-attributes", fmt.Sprintf(`{"category_id": [%d], "page_size": 10}`, categoryID))
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("Content-Type")).To(HavePrefix("application/json"))
+
+		v := h.Current()
+		Expect(w.Header().Get("ETag")).To(Equal(v.ETag))
+		Expect(w.Header().Get("X-Attributes-Version")).To(Equal(strconv.FormatInt(v.Number, 10)))
+
+		res := new(attribute.FindVisibleAttributesResponse)
+		Expect(json.Unmarshal(w.Body.Bytes(), res)).To(Succeed())
+		Expect(res.VAs).ToNot(BeEmpty())
+		Expect(res.PageSize).To(Equal(10))
+
+		w = call(http.MethodGet, "/v1/version", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("ETag")).To(Equal(v.ETag))
+		vr := new(VersionResponse)
+		Expect(json.Unmarshal(w.Body.Bytes(), vr)).To(Succeed())
+		Expect(vr.ETag).To(Equal(v.ETag))
+		Expect(vr.Version).To(Equal(v.Number))
+	})
+
+	It("should reject bad request bodies", func() {
+		w := call(http.MethodPost, "/v1/visible-attributes", `{"category_id": [242], "colour": "red"}`)
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(errorOf(w)).To(ContainSubstring(`unknown field "colour"`))
+
+		w = call(http.MethodPost, "/v1/validate-listing", `{"category_id": "242"`)
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+		large := `{"category_id": [242], "filters": [{"prefix": "` + strings.Repeat("a", MaxRequestBodyBytes) + `"}]}`
+		w = call(http.MethodPost, "/v1/visible-attributes", large)
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(errorOf(w)).To(ContainSubstring("request body too large"))
+	})
+
+	It("should reject bad search conditions without panicking", func() {
+		w := call(http.MethodPost, "/v1/visible-attributes", fmt.Sprintf(`{"category_id": [%d], "offset": -1}`, categoryID))
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(errorOf(w)).To(ContainSubstring(attribute.ErrInvalidOffset.Error()))
+
+		w = call(http.MethodPost, "/v1/visible-attributes", fmt.Sprintf(`{"category_id": [%d], "cursors": ["not-a-cursor"]}`, categoryID))
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+		// No option counter configured
+		w = call(http.MethodPost, "/v1/visible-attributes", fmt.Sprintf(`{"category_id": [%d], "counts": true}`, categoryID))
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should map errors to status codes", func() {
+		for _, err := range []error{
+			attribute.ErrUnknownCategory,
+			attribute.ErrInvalidCursor,
+			attribute.ErrInvalidFilter,
+			attribute.ErrInvalidSort,
+			attribute.ErrInvalidOffset,
+			attribute.ErrInvalidPageSize,
+			attribute.ErrNoOptionCounter,
+		} {
+			Expect(StatusCode(fmt.Errorf("%w: details", err))).To(Equal(http.StatusBadRequest), err.Error())
+		}
+		Expect(StatusCode(errors.New("disk on fire"))).To(Equal(http.StatusInternalServerError))
+	})
+
+	It("should report health", func() {
+		w := call(http.MethodGet, "/healthz", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(MatchJSON(`{"status": "ok"}`))
+	})
+})
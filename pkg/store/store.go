@@ -1,15 +1,19 @@
 package store
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
+	"github.com/anrid/attribute-filters/pkg/importer"
 	badger "github.com/dgraph-io/badger/v4"
 	"github.com/mus-format/mus-go/varint"
 )
 
 var (
-	PrimaryKey = []byte("primary-key")
+	PrimaryKey       = []byte("primary-key")
+	CheckpointPrefix = []byte("checkpoint:")
 )
 
 type Store struct {
@@ -52,6 +56,42 @@ func (s *Store) GetBytes(pk uint64) (bytes []byte, err error) {
 	return
 }
 
+// SaveCheckpoint implements importer.Checkpoints.
+func (s *Store) SaveCheckpoint(name string, c *importer.Checkpoint) error {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(checkpointKey(name), bytes)
+	})
+}
+
+// LoadCheckpoint implements importer.Checkpoints.
+func (s *Store) LoadCheckpoint(name string) (c *importer.Checkpoint, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(checkpointKey(name))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(bs []byte) error {
+			c = new(importer.Checkpoint)
+			return json.Unmarshal(bs, c)
+		})
+	})
+
+	return
+}
+
+func checkpointKey(name string) []byte {
+	return append(append([]byte{}, CheckpointPrefix...), name...)
+}
+
 func (s *Store) PrimaryKey() (num uint64) {
 	var err error
 	if s.pk == nil {
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/anrid/attribute-filters/pkg/importer"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestStore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Store Suite")
+}
+
+var _ = Describe("Storing data in Badger", Label("store"), func() {
+	var s *Store
+
+	BeforeEach(func() {
+		s = New()
+		DeferCleanup(s.Connect(GinkgoT().TempDir()))
+	})
+
+	It("should save and load checkpoints by name", func() {
+		c, err := s.LoadCheckpoint("items")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c).To(BeNil())
+
+		Expect(s.SaveCheckpoint("items", &importer.Checkpoint{File: "items_1.csv", Record: 51, Batch: 3, Records: 300})).To(Succeed())
+		Expect(s.SaveCheckpoint("other", &importer.Checkpoint{File: "other.csv"})).To(Succeed())
+
+		c, err = s.LoadCheckpoint("items")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*c).To(Equal(importer.Checkpoint{File: "items_1.csv", Record: 51, Batch: 3, Records: 300}))
+	})
+
+	It("should keep checkpoints apart from values stored by primary key", func() {
+		pk := s.PrimaryKey()
+		Expect(s.SetBytes(pk, []byte("value"))).To(Succeed())
+		Expect(s.SaveCheckpoint("items", &importer.Checkpoint{File: "items_1.csv"})).To(Succeed())
+
+		b, err := s.GetBytes(pk)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(b)).To(Equal("value"))
+	})
+})